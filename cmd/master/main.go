@@ -2,23 +2,103 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 	"strings"
+	"time"
 	"v_enonce/mapreduce"
 )
 
+// usageError prints a misuse of the flags and exits with status 2
+func usageError(msg string) {
+	fmt.Fprintln(os.Stderr, "master: "+msg)
+	flag.Usage()
+	os.Exit(2)
+}
+
+// exit stops the master with the status matching err, see
+// mapreduce.ExitCode
+func exit(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "master:", err)
+	}
+	os.Exit(mapreduce.ExitCode(err))
+}
+
 // fonction main pour le programme master
 func main() {
 	jobName := flag.String("job", "testjob", "Job name")
 	files := flag.String("files", "", "Comma-separated input files")
 	nReduce := flag.Int("nreduce", 2, "Number of reduce tasks")
+	app := flag.String("app", mapreduce.WordCountApp, "Registered application to run")
+	splitSize := flag.Int64("split", 0, "Split input files in map tasks of about this many bytes (0: one map task per file)")
+	memoryBudget := flag.Int64("memory", 64<<20, "Bytes a reduce task sorts in memory before spilling to disk")
+	partitioner := flag.String("partitioner", "hash", "Reduce partitioner: hash, range:<b1,b2,...>, prefix:<n> or a registered name")
+	heartbeat := flag.Duration("heartbeat", time.Second, "Expected interval between worker heartbeats")
+	missed := flag.Int("missed", 3, "Missed heartbeats before a worker is considered crashed")
+	speculation := flag.Float64("speculation", 2, "Back up tasks running this many times slower than the median (0 disables)")
+	maxAttempts := flag.Int("max-attempts", 4, "Failed attempts of a task after which its job fails (0: no limit)")
+	serve := flag.Bool("serve", false, "Keep running and accept jobs submitted over RPC")
+	logPath := flag.String("log", "", "Write-ahead log of the master, needed to recover after a crash")
+	recoverMaster := flag.Bool("recover", false, "Rebuild the jobs from the log of a previous master and resume them")
+	rpcAddr := flag.String("rpc", ":1234", "RPC address, dialed by the workers and the standby masters (port 0 picks a free port)")
+	httpAddr := flag.String("http", ":8080", "Dashboard address (port 0 picks a free port)")
+	leasePath := flag.String("lease", "", "Lease file shared with standby masters; the master leads while it holds the lease (needs -log and -serve)")
+	leaseDuration := flag.Duration("lease-duration", 3*time.Second, "Time without renewal after which a standby takes over the lease")
+	linger := flag.Duration("linger", 30*time.Second, "Time the master keeps the dashboard up and tells workers to exit once the jobs are done")
 	flag.Parse()
 
-	if *files == "" {
-		mapreduce.CheckError(nil, "No input files provided\n")
+	if *recoverMaster && *logPath == "" {
+		usageError("-recover needs -log")
+	}
+	if *leasePath != "" && (*logPath == "" || !*serve || *files != "") {
+		usageError("-lease needs -log and -serve, jobs are then submitted with mrctl")
+	}
+	if *files == "" && !*serve && !*recoverMaster {
+		usageError("no input files provided")
 	}
-	fileList := strings.Split(*files, ",")
 
 	// Start the master
-	master := mapreduce.NewMaster(*jobName, fileList, *nReduce)
-	master.Run()
+	config := mapreduce.MasterConfig{
+		HeartbeatInterval: *heartbeat,
+		MissedHeartbeats:  *missed,
+		SpeculationFactor: *speculation,
+		MaxAttempts:       *maxAttempts,
+		LogPath:           *logPath,
+		RPCAddr:           *rpcAddr,
+		HTTPAddr:          *httpAddr,
+		LeasePath:         *leasePath,
+		LeaseDuration:     *leaseDuration,
+		Linger:            *linger,
+	}
+	var master *mapreduce.Master
+	var err error
+	if *recoverMaster {
+		master, err = mapreduce.RecoverMaster(config)
+	} else {
+		master, err = mapreduce.NewMasterWithConfig(config)
+	}
+	if err != nil {
+		exit(err)
+	}
+	// A recovered master already knows the job it was started with
+	var existing mapreduce.GetJobReply
+	if *files != "" && master.GetJob(&mapreduce.GetJobArgs{Name: *jobName}, &existing) != nil {
+		err := master.Submit(mapreduce.JobSpec{
+			Name:         *jobName,
+			App:          *app,
+			Files:        strings.Split(*files, ","),
+			NReduce:      *nReduce,
+			Partitioner:  *partitioner,
+			SplitSize:    *splitSize,
+			MemoryBudget: *memoryBudget,
+		})
+		if err != nil {
+			exit(err)
+		}
+	}
+	if *serve {
+		exit(master.Serve())
+	}
+	exit(master.Run())
 }
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/rpc"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"v_enonce/mapreduce"
+)
+
+const usage = `Usage: mrctl [-master addr[,addr...]] [-json] <command> [arguments]
+
+Commands:
+  submit -job name -files a,b [-app wordcount] [-nreduce 2] [-partitioner hash]
+         [-split 0] [-memory 0] [-watch]
+                 submit a job
+  list           list the jobs of the master
+  status <job>   show a job and its tasks
+  watch <job>    print the progress of a job until it finishes
+  cancel <job>   cancel a queued or running job
+  output <job>   print the file holding the result of a finished job
+`
+
+// fonction main pour le client en ligne de commande du master
+func main() {
+	masterAddrs := flag.String("master", "localhost:1234", "Master RPC address, or comma-separated addresses of a leader and its standby masters")
+	jsonOutput := flag.Bool("json", false, "Print JSON instead of tables")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &ctl{masters: strings.Split(*masterAddrs, ","), json: *jsonOutput}
+
+	args := flag.Args()[1:]
+	switch flag.Arg(0) {
+	case "submit":
+		c.submit(args)
+	case "list":
+		c.list()
+	case "status":
+		c.status(jobArg(args))
+	case "watch":
+		c.watch(jobArg(args))
+	case "cancel":
+		c.cancel(jobArg(args))
+	case "output":
+		c.output(jobArg(args))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// ctl runs the commands against a master
+type ctl struct {
+	masters []string
+	json    bool
+}
+
+// fail prints an error and exits with status 1
+func fail(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, "mrctl: "+format+"\n", a...)
+	os.Exit(1)
+}
+
+// jobArg returns the job name argument of a command
+func jobArg(args []string) string {
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	return args[0]
+}
+
+// call calls an RPC on the first master that can be reached and, for the
+// RPCs that change jobs, that leads
+func (c *ctl) call(method string, args, reply interface{}) {
+	var err error
+	for _, addr := range c.masters {
+		var client *rpc.Client
+		client, err = rpc.DialHTTP("tcp", addr)
+		if err != nil {
+			err = fmt.Errorf("cannot connect to master %s: %v", addr, err)
+			continue
+		}
+		err = client.Call(method, args, reply)
+		client.Close()
+		if !mapreduce.IsNotLeader(err) {
+			break
+		}
+	}
+	if err != nil {
+		fail("%s: %v", strings.TrimPrefix(method, "Master."), err)
+	}
+}
+
+func (c *ctl) printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// printJobs prints one line per job
+func (c *ctl) printJobs(jobs []mapreduce.JobStatus) {
+	if c.json {
+		c.printJSON(jobs)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "JOB\tAPP\tSTATE\tPHASE\tTASKS\tOUTPUT")
+	for _, job := range jobs {
+		state := string(job.State)
+		if job.Error != "" {
+			state += ": " + job.Error
+		}
+		output := job.Output
+		if output == "" {
+			output = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d/%d\t%s\n", job.Name, job.App, state, job.Phase, job.TasksDone, job.TotalTasks, output)
+	}
+	w.Flush()
+}
+
+func (c *ctl) submit(args []string) {
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	jobName := fs.String("job", "", "Job name")
+	files := fs.String("files", "", "Comma-separated input files")
+	app := fs.String("app", mapreduce.WordCountApp, "Registered application to run")
+	nReduce := fs.Int("nreduce", 2, "Number of reduce tasks")
+	partitioner := fs.String("partitioner", "hash", "Reduce partitioner: hash, range:<b1,b2,...>, prefix:<n> or a registered name")
+	splitSize := fs.Int64("split", 0, "Split input files in map tasks of about this many bytes (0: one map task per file)")
+	memoryBudget := fs.Int64("memory", 0, "Bytes a reduce task sorts in memory before spilling to disk (0: default)")
+	watch := fs.Bool("watch", false, "Watch the job until it finishes")
+	fs.Parse(args)
+	if *jobName == "" || *files == "" {
+		fail("submit needs -job and -files")
+	}
+
+	var reply mapreduce.SubmitJobReply
+	c.call("Master.SubmitJob", &mapreduce.SubmitJobArgs{Spec: mapreduce.JobSpec{
+		Name:         *jobName,
+		App:          *app,
+		Files:        strings.Split(*files, ","),
+		NReduce:      *nReduce,
+		Partitioner:  *partitioner,
+		SplitSize:    *splitSize,
+		MemoryBudget: *memoryBudget,
+	}}, &reply)
+	if *watch {
+		c.watch(*jobName)
+		return
+	}
+	c.printJobs([]mapreduce.JobStatus{reply.Job})
+}
+
+func (c *ctl) list() {
+	var reply mapreduce.ListJobsReply
+	c.call("Master.ListJobs", &mapreduce.ListJobsArgs{}, &reply)
+	c.printJobs(reply.Jobs)
+}
+
+func (c *ctl) status(name string) {
+	var reply mapreduce.GetJobReply
+	c.call("Master.GetJob", &mapreduce.GetJobArgs{Name: name}, &reply)
+	if c.json {
+		c.printJSON(reply)
+		return
+	}
+	c.printJobs([]mapreduce.JobStatus{reply.Job})
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TASK\tTYPE\tSTATUS\tWORKER\tATTEMPTS\tLAST ERROR")
+	for _, task := range reply.Tasks {
+		worker := task.WorkerID
+		if worker == "" {
+			worker = "-"
+		}
+		lastError := "-"
+		for _, attempt := range task.Attempts {
+			if attempt.Error != "" {
+				lastError = attempt.Error
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\n", task.ID, task.Type, task.Status, worker, len(task.Attempts), lastError)
+	}
+	w.Flush()
+}
+
+// watch prints a progress line, or a JSON object, whenever the job changes,
+// and exits with the status of mapreduce.ExitCode if the job fails or is
+// cancelled
+func (c *ctl) watch(name string) {
+	var last mapreduce.JobStatus
+	for first := true; ; first = false {
+		var reply mapreduce.GetJobReply
+		c.call("Master.GetJob", &mapreduce.GetJobArgs{Name: name}, &reply)
+		job := reply.Job
+		if first || job.State != last.State || job.Phase != last.Phase || job.TasksDone != last.TasksDone {
+			if c.json {
+				json.NewEncoder(os.Stdout).Encode(job)
+			} else {
+				fmt.Printf("%s  %s  %-9s %-6s %d/%d tasks\n", time.Now().Format("15:04:05"), job.Name, job.State, job.Phase, job.TasksDone, job.TotalTasks)
+			}
+		}
+		last = job
+
+		switch job.State {
+		case mapreduce.JobDone:
+			if !c.json {
+				fmt.Printf("output: %s\n", job.Output)
+			}
+			return
+		case mapreduce.JobFailed, mapreduce.JobCancelled:
+			err := job.Err()
+			fmt.Fprintln(os.Stderr, "mrctl:", err)
+			os.Exit(mapreduce.ExitCode(err))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *ctl) cancel(name string) {
+	var reply mapreduce.CancelJobReply
+	c.call("Master.CancelJob", &mapreduce.CancelJobArgs{Name: name}, &reply)
+	c.printJobs([]mapreduce.JobStatus{reply.Job})
+}
+
+func (c *ctl) output(name string) {
+	var reply mapreduce.GetJobReply
+	c.call("Master.GetJob", &mapreduce.GetJobArgs{Name: name}, &reply)
+	if reply.Job.State != mapreduce.JobDone {
+		fail("job %s is %s, it has no output yet", name, reply.Job.State)
+	}
+	if c.json {
+		c.printJSON(map[string]string{"job": name, "output": reply.Job.Output})
+		return
+	}
+	fmt.Println(reply.Job.Output)
+}
@@ -2,19 +2,60 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
 	"v_enonce/mapreduce"
 )
 
 // fonction main pour le programme worker
 func main() {
-	masterAddr := flag.String("master", "localhost:1234", "Master RPC address")
+	masterAddrs := flag.String("master", "localhost:1234", "Master RPC address, or comma-separated addresses of a leader and its standby masters")
 	id := flag.String("id", "", "Worker ID")
+	heartbeat := flag.Duration("heartbeat", time.Second, "Interval between heartbeats to the master")
+	dir := flag.String("dir", "", "Directory of the intermediate and output files of the tasks (default the current directory)")
+	poll := flag.Duration("poll", 10*time.Second, "How long the master may hold a request for a task when none is ready, 0 to poll every second")
+	rest := flag.Duration("rest", 0, "How long the worker waits after executing a task before reporting it, to slow jobs down for demos")
+	slots := flag.Int("slots", 1, "Number of tasks the worker runs at once")
+	chaosPath := flag.String("chaos", "", "JSON file of fault injection settings (mapreduce.ChaosConfig), no faults when empty")
+	chaosSeed := flag.Int64("chaos-seed", 0, "Seed of the fault injection, replacing the one of the -chaos file when not zero")
+	fetchTimeout := flag.Duration("fetch-timeout", mapreduce.DefaultFetchTimeout, "How long fetching a file from another worker may take before its map task runs again")
+	shuffle := flag.String("shuffle", "", "Address of the HTTP server serving the files of the worker, such as :7000, for workers that do not share a directory")
 	flag.Parse()
 
 	if *id == "" {
-		mapreduce.CheckError(nil, "Worker ID not provided\n")
+		fmt.Fprintln(os.Stderr, "worker: no worker ID provided")
+		flag.Usage()
+		os.Exit(2)
 	}
 
-	worker := mapreduce.NewWorker(*id, *masterAddr)
-	worker.Run()
+	var chaos mapreduce.ChaosConfig
+	if *chaosPath != "" {
+		var err error
+		if chaos, err = mapreduce.LoadChaosConfig(*chaosPath); err != nil {
+			fmt.Fprintln(os.Stderr, "worker:", err)
+			os.Exit(2)
+		}
+	}
+	if *chaosSeed != 0 {
+		chaos.Seed = *chaosSeed
+	}
+
+	masters := strings.Split(*masterAddrs, ",")
+	worker := mapreduce.NewWorkerWithConfig(*id, masters[0], mapreduce.WorkerConfig{
+		HeartbeatInterval: *heartbeat,
+		StandbyMasters:    masters[1:],
+		Dir:               *dir,
+		ShuffleAddr:       *shuffle,
+		FetchTimeout:      *fetchTimeout,
+		Slots:             *slots,
+		PollTimeout:       *poll,
+		Rest:              *rest,
+		Chaos:             chaos,
+	})
+	if err := worker.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "worker:", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,97 @@
+package mapreduce
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// App bundles the functions of a MapReduce application. Tasks only carry the
+// application name, so every worker that should run an application must
+// register it (usually from an init function) before calling Worker.Run.
+//
+// The map function is given either as Map, called on each record, or as
+// the streaming MapRecords, and the reduce function as Reduce or as the
+// streaming ReduceValues. The streaming forms take precedence.
+type App struct {
+	Name         string
+	Map          func(contents string) []KeyValue
+	MapRecords   RecordMapFunc
+	Reduce       func(key string, values []string) string
+	ReduceValues IterReduceFunc
+	Combine      func(key string, values []string) string // optional
+	Reader       ReaderFunc                               // optional, see recordReader
+}
+
+// recordMapper returns the map function of the app in its streaming form
+func (app App) recordMapper() RecordMapFunc {
+	if app.MapRecords != nil {
+		return app.MapRecords
+	}
+	return MapAdapter(app.Map)
+}
+
+// recordReader returns the reader of the input of the app: a Map function
+// gets the whole split, like DoMap gives it the whole file, and a
+// MapRecords function gets lines unless the app says otherwise
+func (app App) recordReader() ReaderFunc {
+	if app.Reader != nil {
+		return app.Reader
+	}
+	if app.MapRecords == nil {
+		return NewSplitReader
+	}
+	return NewLineReader
+}
+
+// iterReducer returns the reduce function of the app in its streaming form
+func (app App) iterReducer() IterReduceFunc {
+	if app.ReduceValues != nil {
+		return app.ReduceValues
+	}
+	return ReduceAdapter(app.Reduce)
+}
+
+var (
+	appsMu sync.RWMutex
+	apps   = make(map[string]App)
+)
+
+// RegisterApp makes an application available under app.Name. It panics if
+// the name is empty or already taken, or if the map or reduce function is
+// missing, the same way http.Handle does for a bad pattern.
+func RegisterApp(app App) {
+	appsMu.Lock()
+	defer appsMu.Unlock()
+
+	if app.Name == "" {
+		panic("mapreduce: RegisterApp with empty name")
+	}
+	if (app.Map == nil && app.MapRecords == nil) || (app.Reduce == nil && app.ReduceValues == nil) {
+		panic(fmt.Sprintf("mapreduce: app %q needs both a map and a reduce function", app.Name))
+	}
+	if _, exists := apps[app.Name]; exists {
+		panic(fmt.Sprintf("mapreduce: app %q registered twice", app.Name))
+	}
+	apps[app.Name] = app
+}
+
+// LookupApp returns the application registered under name.
+func LookupApp(name string) (App, bool) {
+	appsMu.RLock()
+	defer appsMu.RUnlock()
+	app, ok := apps[name]
+	return app, ok
+}
+
+// Apps returns the names of all registered applications, sorted.
+func Apps() []string {
+	appsMu.RLock()
+	defer appsMu.RUnlock()
+	names := make([]string, 0, len(apps))
+	for name := range apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,152 @@
+package mapreduce
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"runtime"
+	"time"
+)
+
+// Fault injection makes workers crash, stall or lose RPC replies on
+// purpose, to check that jobs still complete. It is off unless a worker is
+// given a ChaosConfig with non-zero rates.
+//
+// Whether a fault hits an attempt only depends on the seed, the attempt and
+// the injection point, not on the order in which workers run tasks: a run
+// with the same seed replays the same faults, and a retry of a task gets new
+// draws.
+
+// ChaosPoint is a point of a task attempt where a fault can be injected
+type ChaosPoint string
+
+const (
+	// ChaosCrash makes the worker crash before executing the task
+	ChaosCrash ChaosPoint = "crash"
+	// ChaosDelay stalls the worker for ChaosConfig.Delay before executing
+	// the task
+	ChaosDelay ChaosPoint = "delay"
+	// ChaosMidWrite makes the worker crash after the task wrote its first
+	// record, leaving partial output files
+	ChaosMidWrite ChaosPoint = "mid-write"
+	// ChaosBeforeReport makes the worker crash once the task is executed,
+	// before it is reported
+	ChaosBeforeReport ChaosPoint = "before-report"
+	// ChaosDropReply makes the worker lose the reply to the GetTask request
+	// handing out the task, as a broken connection would: the master runs
+	// the attempt until the heartbeats of the worker leave it out
+	ChaosDropReply ChaosPoint = "drop-reply"
+)
+
+// ChaosRates are the probabilities of the faults at each injection point,
+// from 0 to 1
+type ChaosRates struct {
+	Crash        float64
+	Delay        float64
+	MidWrite     float64
+	BeforeReport float64
+	DropReply    float64
+}
+
+// rate returns the probability of a fault at point
+func (r ChaosRates) rate(point ChaosPoint) float64 {
+	switch point {
+	case ChaosCrash:
+		return r.Crash
+	case ChaosDelay:
+		return r.Delay
+	case ChaosMidWrite:
+		return r.MidWrite
+	case ChaosBeforeReport:
+		return r.BeforeReport
+	case ChaosDropReply:
+		return r.DropReply
+	}
+	return 0
+}
+
+// ChaosConfig holds the fault injection settings of a worker. The zero
+// value injects no fault.
+type ChaosConfig struct {
+	Seed   int64
+	Map    ChaosRates    // Rates for map tasks
+	Reduce ChaosRates    // Rates for reduce tasks
+	Delay  time.Duration // Length of the delays, 5s when zero
+}
+
+// LoadChaosConfig reads a ChaosConfig from a JSON file such as
+//
+//	{"Seed": 42, "Map": {"Crash": 0.05, "Delay": 0.1}, "Reduce": {"DropReply": 0.2}, "Delay": 5000000000}
+func LoadChaosConfig(path string) (ChaosConfig, error) {
+	var config ChaosConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("cannot parse chaos config %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// enabled tells whether the config injects any fault
+func (c ChaosConfig) enabled() bool {
+	return c.Map != (ChaosRates{}) || c.Reduce != (ChaosRates{})
+}
+
+// Injects tells whether a fault hits the attempt of task at point
+func (c ChaosConfig) Injects(point ChaosPoint, task Task) bool {
+	rates := c.Map
+	if task.Type == ReduceTask {
+		rates = c.Reduce
+	}
+	rate := rates.rate(point)
+	if rate <= 0 {
+		return false
+	}
+	// Draw from a hash of the seed, the attempt and the point
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, c.Seed)
+	fmt.Fprintf(h, "%s/%d/%d/%s", task.JobName, task.ID, task.Attempt, point)
+	return float64(h.Sum64()>>11)/(1<<53) < rate
+}
+
+// delay returns the length of the delays
+func (c ChaosConfig) delay() time.Duration {
+	if c.Delay <= 0 {
+		return 5 * time.Second
+	}
+	return c.Delay
+}
+
+// chaosExit is how a worker crashes on purpose: it is killed, and the
+// task stops where it is, without cleaning up
+func (w *Worker) chaosExit(point ChaosPoint, task Task) {
+	Debug("Worker %s: Chaos: %s at task %s/%d (attempt %d)\n", w.id, point, task.JobName, task.ID, task.Attempt)
+	w.Kill()
+	runtime.Goexit()
+}
+
+// afterWrite returns the Options.AfterWrite hook injecting ChaosMidWrite
+// into the attempt of task, nil when it is not hit
+func (w *Worker) afterWrite(task Task) func(written int64) {
+	if !w.config.Chaos.Injects(ChaosMidWrite, task) {
+		return nil
+	}
+	return func(written int64) {
+		w.chaosExit(ChaosMidWrite, task)
+	}
+}
+
+// dropReply injects ChaosDropReply into the GetTask reply handing out the
+// attempt of task, and tells whether the worker must act as if it never
+// got it
+func (w *Worker) dropReply(task Task) bool {
+	if !w.config.Chaos.Injects(ChaosDropReply, task) {
+		return false
+	}
+	Debug("Worker %s: Chaos: %s at task %s/%d (attempt %d)\n", w.id, ChaosDropReply, task.JobName, task.ID, task.Attempt)
+	return true
+}
@@ -0,0 +1,198 @@
+package mapreduce
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ErrNoLog is returned when recovering a master, or electing masters,
+// without MasterConfig.LogPath
+var ErrNoLog = errors.New("mapreduce: master has no log")
+
+// logRecord is one entry of the master's write-ahead log. The log holds the
+// transitions that cannot be rebuilt from the files on disk: submitted jobs
+// with their splits, completed tasks, tasks whose output was lost and
+// finished jobs. Running attempts are not logged, their tasks are pending
+// again after a recovery.
+type logRecord struct {
+	Op       string // "submit", "start", "complete", "lost", "finish" or "cancel"
+	Time     time.Time
+	Job      string
+	Spec     *JobSpec  `json:",omitempty"` // submit
+	Splits   []Split   `json:",omitempty"` // submit
+	TaskID   int       `json:",omitempty"` // complete, lost
+	WorkerID string    `json:",omitempty"` // complete
+	Counters *Counters `json:",omitempty"` // complete
+	Tag      string    `json:",omitempty"` // complete, the committed attempt
+	Address  string    `json:",omitempty"` // complete, where its output is served
+	State    JobState  `json:",omitempty"` // finish
+	Error    string    `json:",omitempty"` // finish
+	Kind     string    `json:",omitempty"` // finish
+}
+
+// masterLog appends records to the write-ahead log, one JSON object per
+// line, and syncs the file after each of them
+type masterLog struct {
+	file *os.File
+	enc  *json.Encoder
+}
+
+// openLog opens the log at path for appending, creating it if needed
+func openLog(path string, flag int) (*masterLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &masterLog{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+func (l *masterLog) append(r logRecord) error {
+	if err := l.enc.Encode(&r); err != nil {
+		return err
+	}
+	return l.file.Sync()
+}
+
+// record writes r to the log of the master, if it has one. It must be
+// called with m.mu held, before the reply that depends on it is sent.
+func (m *Master) record(r logRecord) error {
+	if m.log == nil {
+		return nil
+	}
+	if !m.leading() {
+		return ErrNotLeader
+	}
+	r.Time = m.clock.Now()
+	if err := m.log.append(r); err != nil {
+		return fmt.Errorf("cannot write master log: %v", err)
+	}
+	return nil
+}
+
+// RecoverMaster rebuilds a master from the log at config.LogPath, written by
+// a master that stopped or crashed, and keeps appending to it. Completed
+// tasks keep their intermediate files; tasks that were running are handed
+// out again. A job whose tasks had all completed is merged again unless
+// its end was logged. A missing log gives an empty master.
+func RecoverMaster(config MasterConfig) (*Master, error) {
+	if config.LogPath == "" {
+		return nil, ErrNoLog
+	}
+	m, err := newMaster(config)
+	if err != nil {
+		return nil, err
+	}
+	m.eligible = true
+
+	size, err := m.replay(config.LogPath)
+	if err != nil {
+		return nil, err
+	}
+	m.log, err = openLog(config.LogPath, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Drop a record torn by the crash so that new ones start on a fresh line
+	if err := m.log.file.Truncate(size); err != nil {
+		return nil, err
+	}
+	if _, err := m.log.file.Seek(size, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	// With a lease file the jobs are resumed once the master leads
+	if m.lease == nil {
+		m.resume()
+	}
+	return m, nil
+}
+
+// replay applies the records of the log at path and returns the size of the
+// part of the log that could be read
+func (m *Master) replay(path string) (int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		Debug("Master: No log at %s, starting empty\n", path)
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	var size int64
+	records := 0
+	for {
+		var r logRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			Debug("Master: Ignoring the end of log %s after %d records: %v\n", path, records, err)
+			break
+		}
+		if err := m.apply(r); err != nil {
+			return 0, fmt.Errorf("master log %s, record %d: %v", path, records+1, err)
+		}
+		size = dec.InputOffset()
+		records++
+	}
+	// Keep the newline ending the last record
+	if info, err := file.Stat(); err == nil && size < info.Size() {
+		size++
+	}
+	Debug("Master: Recovered %d jobs from %d records of %s\n", len(m.jobs), records, path)
+	return size, nil
+}
+
+// apply replays one record of the log
+func (m *Master) apply(r logRecord) error {
+	if r.Op == "submit" {
+		if r.Spec == nil {
+			return fmt.Errorf("submit record without a spec")
+		}
+		m.jobs = append(m.jobs, newJob(*r.Spec, r.Splits, r.Time))
+		return nil
+	}
+	j := m.job(r.Job)
+	if j == nil {
+		return fmt.Errorf("%s record for unknown job %q", r.Op, r.Job)
+	}
+	switch r.Op {
+	case "start":
+		j.state = JobRunning
+		j.startedAt = r.Time
+	case "complete":
+		if r.TaskID < 0 || r.TaskID >= len(j.tasks) {
+			return fmt.Errorf("job %q has no task %d", r.Job, r.TaskID)
+		}
+		task := &j.tasks[r.TaskID]
+		if task.Status != "completed" {
+			j.tasksDone++
+		}
+		task.Status = "completed"
+		task.WorkerID = r.WorkerID
+		task.Committed = r.Tag
+		task.Location = r.Address
+		if r.Counters != nil {
+			task.Counters = *r.Counters
+		}
+	case "lost":
+		if r.TaskID < 0 || r.TaskID >= len(j.tasks) {
+			return fmt.Errorf("job %q has no task %d", r.Job, r.TaskID)
+		}
+		j.reset(r.TaskID)
+	case "finish", "cancel":
+		j.state = r.State
+		j.err = r.Error
+		j.errKind = r.Kind
+		j.finishedAt = r.Time
+	default:
+		return fmt.Errorf("unknown operation %q", r.Op)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package mapreduce
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time to the master and the workers: heartbeats, the
+// detection of crashed workers, backups of stragglers and the waits of
+// workers go by it. Tests pass a FakeClock to test timeouts without
+// sleeping.
+type Clock interface {
+	Now() time.Time
+	// After returns a channel receiving the time once d has elapsed
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the Clock of the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// clockOrReal returns clock, or the real clock when it is nil
+func clockOrReal(clock Clock) Clock {
+	if clock == nil {
+		return realClock{}
+	}
+	return clock
+}
+
+// FakeClock is a Clock whose time only moves when Advance is called
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// fakeWaiter is a channel returned by After, waiting for its time
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// NewFakeClock returns a FakeClock set to start
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Advance moves the time forward by d and fires the channels of After
+// whose time has come, in the order of their times
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.waiters, func(i, j int) bool { return c.waiters[i].at.Before(c.waiters[j].at) })
+	fired := 0
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			break
+		}
+		waiter.ch <- waiter.at
+		fired++
+	}
+	c.waiters = c.waiters[fired:]
+}
@@ -0,0 +1,78 @@
+package mapreduce
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Every attempt of a task writes its output files under names of its own,
+// so that a worker dying in the middle of a write or a late duplicate
+// attempt never touches the files other tasks read. The master commits the
+// first attempt to complete by recording its tag: reduce tasks then read the
+// intermediate files of the committed map attempts, and the output of a job
+// is merged from the files of the committed reduce attempts.
+
+// attemptSeparator sits between the name of a file and the tag of the
+// attempt writing it
+const attemptSeparator = ".attempt-"
+
+// localAttempts numbers the attempts run without a tag, see localTag
+var localAttempts int64
+
+// AttemptName constructs the name under which the attempt tagged <tag>
+// writes the file <name>. An empty tag stands for the file itself.
+func AttemptName(name string, tag string) string {
+	if tag == "" {
+		return name
+	}
+	return name + attemptSeparator + tag
+}
+
+// attemptTag tags a new attempt of a task. The start time keeps tags
+// unique across masters, which number attempts from 1 again.
+func attemptTag(attempt int, now time.Time) string {
+	return fmt.Sprintf("%d-%x", attempt, now.UnixNano())
+}
+
+// localTag tags a task run outside of a master, by Sequential or by a
+// direct call to DoMap or DoReduce
+func localTag() string {
+	return fmt.Sprintf("local-%d-%d", os.Getpid(), atomic.AddInt64(&localAttempts, 1))
+}
+
+// commitFiles renames the files written by the attempt tagged <tag> to
+// their final names. Each rename replaces a final file in one step.
+func commitFiles(names []string, tag string) error {
+	for _, name := range names {
+		if err := os.Rename(AttemptName(name, tag), name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// discardFiles removes the files written by the attempt tagged <tag>
+func discardFiles(names []string, tag string) {
+	for _, name := range names {
+		os.Remove(AttemptName(name, tag))
+	}
+}
+
+// removeAttempts removes the files of every attempt in dir, committed or
+// not, whose final name is in names. Other jobs may share the prefix of the
+// job name, hence the check of the final names.
+func removeAttempts(dir, jobName string, names map[string]bool) {
+	matches, err := filepath.Glob(filepath.Join(dir, prefix+jobName+"-*"+attemptSeparator+"*"))
+	if err != nil {
+		return
+	}
+	for _, match := range matches {
+		if i := strings.LastIndex(match, attemptSeparator); i >= 0 && names[match[:i]] {
+			os.Remove(match)
+		}
+	}
+}
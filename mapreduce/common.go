@@ -26,7 +26,8 @@ func CheckError(err error, format string, a ...interface{}) {
 	}
 }
 
-func concatFiles(destination string, sources []string) error {
+// concatFiles concatène n fichiers, ouverts par open, en un seul
+func concatFiles(destination string, n int, open func(i int) (io.ReadCloser, error)) error {
 	// Create or open the destination file
 	destFile, err := os.Create(destination)
 	if err != nil {
@@ -35,8 +36,8 @@ func concatFiles(destination string, sources []string) error {
 	defer destFile.Close()
 
 	// Copy the content of each source file
-	for _, src := range sources {
-		srcFile, err := os.Open(src)
+	for i := 0; i < n; i++ {
+		srcFile, err := open(i)
 		if err != nil {
 			return err
 		}
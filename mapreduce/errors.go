@@ -0,0 +1,157 @@
+package mapreduce
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Kinds of task errors, to be checked with errors.Is
+var (
+	// ErrMissingInput: an input file or the output of a map task cannot be
+	// opened
+	ErrMissingInput = errors.New("missing input")
+	// ErrCorruptIntermediate: an intermediate file does not hold valid
+	// key/value pairs
+	ErrCorruptIntermediate = errors.New("corrupt intermediate file")
+	// ErrWriteFailed: an intermediate or output file cannot be written
+	ErrWriteFailed = errors.New("write failed")
+)
+
+// ErrWorkerKilled is returned by Worker.Run once the worker was killed, see
+// Worker.Kill
+var ErrWorkerKilled = errors.New("mapreduce: worker killed")
+
+// errorKinds are the kinds of task errors, see errorKind
+var errorKinds = []error{ErrMissingInput, ErrCorruptIntermediate, ErrWriteFailed}
+
+// TaskError is the error of a map or reduce task, or of the merge of the
+// output of a job. errors.Is matches its Kind, and errors.As gives access to
+// the task and to the file involved.
+type TaskError struct {
+	Op   string // "map", "reduce" or "merge"
+	Job  string
+	Task int    // Map or reduce task number, unused for merges
+	File string // File that could not be read or written, if any
+	Kind error  // One of the kinds above, nil for other errors
+	Err  error
+}
+
+func (e *TaskError) Error() string {
+	msg := fmt.Sprintf("mapreduce: %s task %d of job %s", e.Op, e.Task, e.Job)
+	if e.Op == "merge" {
+		msg = fmt.Sprintf("mapreduce: merge of job %s", e.Job)
+	}
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *TaskError) Unwrap() error { return e.Err }
+
+// Is reports whether target is the kind of the error
+func (e *TaskError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// openError classifies the failure to open a file read by a task
+func openError(op, job string, task int, file string, err error) error {
+	kind := ErrMissingInput
+	if !os.IsNotExist(err) && !os.IsPermission(err) {
+		kind = nil
+	}
+	return &TaskError{Op: op, Job: job, Task: task, File: file, Kind: kind, Err: err}
+}
+
+// LostOutputError is the cause of the failure of a reduce task that cannot
+// fetch or decode the output of a map task. The map task has to run again
+// before the reduce task.
+type LostOutputError struct {
+	MapTask int
+	Err     error
+}
+
+func (e *LostOutputError) Error() string {
+	return fmt.Sprintf("output of map task %d lost: %v", e.MapTask, e.Err)
+}
+
+func (e *LostOutputError) Unwrap() error { return e.Err }
+
+// lostOutput marks the task error err as caused by the output of map task
+// mapTask
+func lostOutput(err error, mapTask int) error {
+	if taskErr, ok := err.(*TaskError); ok {
+		taskErr.Err = &LostOutputError{MapTask: mapTask, Err: taskErr.Err}
+	}
+	return err
+}
+
+// lostMapTasks returns the map tasks whose output a reduce task failing
+// with err could not read
+func lostMapTasks(err error) []int {
+	var lost *LostOutputError
+	if errors.As(err, &lost) {
+		return []int{lost.MapTask}
+	}
+	return nil
+}
+
+// errorKind returns the name of the kind of err, empty if it has none. Kinds
+// travel by name in RPCs, see kindError.
+func errorKind(err error) string {
+	for _, kind := range errorKinds {
+		if errors.Is(err, kind) {
+			return kind.Error()
+		}
+	}
+	return ""
+}
+
+// kindError returns the kind named name, nil if there is none
+func kindError(name string) error {
+	for _, kind := range errorKinds {
+		if kind.Error() == name {
+			return kind
+		}
+	}
+	return nil
+}
+
+// JobError is returned by Master.Run when a job did not complete. errors.Is
+// matches the kind of the task error that made it fail, if any.
+type JobError struct {
+	Job    string
+	State  JobState // JobFailed or JobCancelled
+	Reason string
+	Kind   error
+}
+
+func (e *JobError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("mapreduce: job %s %s", e.Job, e.State)
+	}
+	return fmt.Sprintf("mapreduce: job %s %s: %s", e.Job, e.State, e.Reason)
+}
+
+// Is reports whether target is the kind of the error
+func (e *JobError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// ExitCode returns the exit status of a program that stops on err: 0
+// without error, 3 for ErrMissingInput, 4 for ErrCorruptIntermediate, 5 for
+// ErrWriteFailed and 1 otherwise.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrMissingInput):
+		return 3
+	case errors.Is(err, ErrCorruptIntermediate):
+		return 4
+	case errors.Is(err, ErrWriteFailed):
+		return 5
+	}
+	return 1
+}
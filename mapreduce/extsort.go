@@ -0,0 +1,253 @@
+package mapreduce
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// defaultMemoryBudget is the memory a reduce task may use to sort its input
+// when Options.MemoryBudget is not set
+const defaultMemoryBudget = 64 << 20
+
+// kvOverhead approximates the memory taken by a buffered KeyValue on top of
+// the bytes of its key and value
+const kvOverhead = 48
+
+// sortedRun is a sequence of pairs sorted by key
+type sortedRun interface {
+	// next returns io.EOF after the last pair
+	next() (KeyValue, error)
+	close() error
+}
+
+// memoryRun is a sorted run kept in memory
+type memoryRun struct {
+	kvs []KeyValue
+}
+
+func (r *memoryRun) next() (KeyValue, error) {
+	if len(r.kvs) == 0 {
+		return KeyValue{}, io.EOF
+	}
+	kv := r.kvs[0]
+	r.kvs = r.kvs[1:]
+	return kv, nil
+}
+
+func (r *memoryRun) close() error { return nil }
+
+// fileRun is a sorted run spilled to disk, one JSON pair per line
+type fileRun struct {
+	file *os.File
+	dec  *json.Decoder
+}
+
+func (r *fileRun) next() (kv KeyValue, err error) {
+	err = r.dec.Decode(&kv)
+	return kv, err
+}
+
+func (r *fileRun) close() error { return r.file.Close() }
+
+// sorter sorts the pairs of a reduce task within a memory budget: pairs are
+// buffered until the budget is reached, then sorted and spilled to disk as a
+// run, to be merged with the other runs afterwards
+type sorter struct {
+	dir     string // Directory of the spill files
+	pattern string // Pattern of the spill file names, see os.CreateTemp
+	budget  int64
+	size    int64
+	buffer  []KeyValue
+	spills  []string
+}
+
+func newSorter(dir, jobName string, reduceTaskNumber int, budget int64) *sorter {
+	if budget <= 0 {
+		budget = defaultMemoryBudget
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return &sorter{
+		dir:     dir,
+		pattern: prefix + jobName + "-spill-" + strconv.Itoa(reduceTaskNumber) + "-*",
+		budget:  budget,
+	}
+}
+
+func (s *sorter) add(kv KeyValue) error {
+	s.buffer = append(s.buffer, kv)
+	s.size += int64(len(kv.Key)+len(kv.Value)) + kvOverhead
+	if s.size >= s.budget {
+		return s.spill()
+	}
+	return nil
+}
+
+// spill writes the buffered pairs, sorted, to a new run file. The sort is
+// stable so that the values of a key keep the order in which they were read.
+func (s *sorter) spill() error {
+	sort.SliceStable(s.buffer, func(i, j int) bool { return s.buffer[i].Key < s.buffer[j].Key })
+	file, err := os.CreateTemp(s.dir, s.pattern)
+	if err != nil {
+		return err
+	}
+	s.spills = append(s.spills, file.Name())
+	w := bufio.NewWriter(file)
+	enc := json.NewEncoder(w)
+	for i := range s.buffer {
+		if err := enc.Encode(&s.buffer[i]); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	s.buffer = s.buffer[:0]
+	s.size = 0
+	return file.Close()
+}
+
+// runs returns the spilled runs, in spill order, followed by the pairs still
+// in memory
+func (s *sorter) runs() ([]sortedRun, error) {
+	var runs []sortedRun
+	for _, name := range s.spills {
+		file, err := os.Open(name)
+		if err != nil {
+			for _, r := range runs {
+				r.close()
+			}
+			return nil, err
+		}
+		runs = append(runs, &fileRun{file: file, dec: json.NewDecoder(bufio.NewReader(file))})
+	}
+	sort.SliceStable(s.buffer, func(i, j int) bool { return s.buffer[i].Key < s.buffer[j].Key })
+	return append(runs, &memoryRun{kvs: s.buffer}), nil
+}
+
+// cleanup removes the spill files
+func (s *sorter) cleanup() {
+	for _, name := range s.spills {
+		os.Remove(name)
+	}
+}
+
+// mergeItem is the next pair of a run
+type mergeItem struct {
+	kv  KeyValue
+	run int
+}
+
+// mergeHeap orders the head pairs of the runs by key, then by run so that
+// equal keys come out in run order
+type mergeHeap []mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].kv.Key != h[j].kv.Key {
+		return h[i].kv.Key < h[j].kv.Key
+	}
+	return h[i].run < h[j].run
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeItem)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// merger is a k-way merge of sorted runs
+type merger struct {
+	runs []sortedRun
+	heap mergeHeap
+}
+
+// newMerger starts merging the runs. It closes them if it fails.
+func newMerger(runs []sortedRun) (*merger, error) {
+	m := &merger{runs: runs}
+	for i := range runs {
+		if err := m.advance(i); err != nil {
+			m.close()
+			return nil, err
+		}
+	}
+	heap.Init(&m.heap)
+	return m, nil
+}
+
+// advance pushes the next pair of run i, if any
+func (m *merger) advance(i int) error {
+	kv, err := m.runs[i].next()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	heap.Push(&m.heap, mergeItem{kv: kv, run: i})
+	return nil
+}
+
+// next returns the smallest remaining pair, or io.EOF
+func (m *merger) next() (KeyValue, error) {
+	if len(m.heap) == 0 {
+		return KeyValue{}, io.EOF
+	}
+	item := heap.Pop(&m.heap).(mergeItem)
+	if err := m.advance(item.run); err != nil {
+		return KeyValue{}, err
+	}
+	return item.kv, nil
+}
+
+func (m *merger) close() {
+	for _, r := range m.runs {
+		r.close()
+	}
+}
+
+// valueIterator streams the values of one key out of a merger
+type valueIterator struct {
+	merger  *merger
+	key     string
+	head    string // First value of the key, read by the caller
+	hasHead bool
+	next    KeyValue // First pair of the following key once done
+	err     error    // Error that ended the key, io.EOF after the last pair
+	done    bool
+}
+
+func (it *valueIterator) Next() (string, bool) {
+	if it.hasHead {
+		it.hasHead = false
+		return it.head, true
+	}
+	if it.done {
+		return "", false
+	}
+	kv, err := it.merger.next()
+	if err != nil || kv.Key != it.key {
+		it.next, it.err, it.done = kv, err, true
+		return "", false
+	}
+	return kv.Value, true
+}
+
+// skip drops the values the reduce function did not read and returns the
+// first pair of the next key
+func (it *valueIterator) skip() (KeyValue, error) {
+	it.hasHead = false
+	for !it.done {
+		it.Next()
+	}
+	return it.next, it.err
+}
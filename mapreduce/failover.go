@@ -0,0 +1,336 @@
+package mapreduce
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ErrNotLeader is returned by the RPCs that change the state of a master
+// while it is a standby. Workers move on to the next master of their list.
+var ErrNotLeader = errors.New("mapreduce: master is not the leader")
+
+// IsNotLeader reports whether an error returned by an RPC client is
+// ErrNotLeader sent by a master
+func IsNotLeader(err error) bool {
+	return err != nil && err.Error() == ErrNotLeader.Error()
+}
+
+// maxLogChunk bounds the bytes of log sent by one ReadLog reply, unless a
+// single record is larger
+const maxLogChunk = 1 << 20
+
+// leaseRecord is the content of the lease file
+type leaseRecord struct {
+	Holder  string // RPC address of the leader
+	ID      string // Identifies the leader process, which may restart on the same address
+	Expires time.Time
+}
+
+// lease elects a leader among masters sharing a lease file. The leader
+// renews the lease a few times per duration; another master takes it once
+// it has expired. A lock file next to the lease makes each read-modify-write
+// of the lease atomic. The lock holds the ID of its master, which only
+// removes its own lock; a lock left behind by a dead master is broken once
+// it is older than the lease duration.
+type lease struct {
+	path     string
+	addr     string // RPC address of this master
+	id       string
+	duration time.Duration
+}
+
+func newLease(path, addr string, duration time.Duration) *lease {
+	if duration <= 0 {
+		duration = defaultLeaseDuration
+	}
+	id := fmt.Sprintf("%s/%d/%d", addr, os.Getpid(), time.Now().UnixNano())
+	return &lease{path: path, addr: addr, id: id, duration: duration}
+}
+
+// acquire takes the lease if it is free or expired, renews it if this
+// master holds it, and returns the lease as it stands afterwards
+func (l *lease) acquire(now time.Time) (leaseRecord, error) {
+	lock := l.path + ".lock"
+	file, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		// A master that died while holding the lock leaves it behind
+		if info, err := os.Stat(lock); err == nil && now.Sub(info.ModTime()) > l.duration {
+			l.breakLock(lock, now)
+		}
+		return l.read()
+	} else if err != nil {
+		return leaseRecord{}, err
+	}
+	_, err = file.WriteString(l.id)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	defer l.unlock(lock)
+	if err != nil {
+		return leaseRecord{}, err
+	}
+
+	current, err := l.read()
+	if err != nil {
+		return leaseRecord{}, err
+	}
+	if current.ID != l.id && now.Before(current.Expires) {
+		return current, nil
+	}
+	next := leaseRecord{Holder: l.addr, ID: l.id, Expires: now.Add(l.duration)}
+	data, err := json.Marshal(next)
+	if err != nil {
+		return leaseRecord{}, err
+	}
+	// Replace the lease in one step so that readers never see half of it
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return leaseRecord{}, err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		return leaseRecord{}, err
+	}
+	return next, nil
+}
+
+// unlock removes the lock, unless another master broke it and took it
+func (l *lease) unlock(lock string) {
+	if holder, err := os.ReadFile(lock); err == nil && string(holder) == l.id {
+		os.Remove(lock)
+	}
+}
+
+// breakLock removes a stale lock. Several masters may find it stale at
+// once, and one of them may take a new lock in the meantime: each master
+// moves the lock out of the way in one step, checks that it is the stale
+// lock whose holder it read, and puts it back otherwise.
+func (l *lease) breakLock(lock string, now time.Time) {
+	holder, err := os.ReadFile(lock)
+	if err != nil {
+		return
+	}
+	moved := fmt.Sprintf("%s.%s", lock, strconv.FormatInt(time.Now().UnixNano(), 36))
+	if err := os.Rename(lock, moved); err != nil {
+		return
+	}
+	defer os.Remove(moved)
+	info, err := os.Stat(moved)
+	checked, _ := os.ReadFile(moved)
+	if err != nil || now.Sub(info.ModTime()) <= l.duration || !bytes.Equal(checked, holder) {
+		// A live lock: put it back, unless yet another master took the
+		// lock since
+		os.Link(moved, lock)
+		return
+	}
+	Debug("Master: Broke the lease lock of %s\n", holder)
+}
+
+// read returns the current lease, empty if there is none
+func (l *lease) read() (leaseRecord, error) {
+	var current leaseRecord
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return current, nil
+	} else if err != nil {
+		return current, err
+	}
+	if err := json.Unmarshal(data, &current); err != nil {
+		return current, fmt.Errorf("bad lease file %s: %v", l.path, err)
+	}
+	return current, nil
+}
+
+// leading reports whether the master may change its state. A master without
+// a lease file always leads; otherwise it must hold an unexpired lease. It
+// must be called with m.mu held.
+func (m *Master) leading() bool {
+	return m.lease == nil || (m.leader && time.Now().Before(m.leaseExpires))
+}
+
+// elect runs the election of a master with a lease file: it renews or takes
+// the lease, and replicates the log of the leader while it is a standby.
+//
+// Only a master that has the state of the previous leader may take the
+// lease: one that replicated its log, one recovered from its own log, or
+// the first master of a new lease file. A standby started while no leader
+// is alive waits for one.
+func (m *Master) elect() {
+	ticker := time.NewTicker(m.lease.duration / 4)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		select {
+		case <-m.done:
+			return
+		default:
+		}
+		m.mu.Lock()
+		eligible := m.eligible
+		m.mu.Unlock()
+		var current leaseRecord
+		var err error
+		if eligible {
+			current, err = m.lease.acquire(time.Now())
+		} else {
+			current, err = m.lease.read()
+		}
+		if err != nil {
+			Debug("Master: Cannot read lease: %v\n", err)
+			continue
+		}
+
+		m.mu.Lock()
+		if current.ID == m.lease.id {
+			m.leaseExpires = current.Expires
+			if !m.leader {
+				m.takeOver()
+			}
+		} else if m.leader {
+			Debug("Master: Lease taken by %s, stepping down\n", current.Holder)
+			m.leader = false
+			m.following = ""
+		}
+		leader := m.leader
+		m.mu.Unlock()
+
+		if !leader && current.Holder != "" && time.Now().Before(current.Expires) {
+			if err := m.replicate(current); err != nil {
+				Debug("Master: Cannot replicate the log of %s: %v\n", current.Holder, err)
+			}
+		}
+	}
+}
+
+// takeOver makes the master the leader with the state it has replicated.
+// Tasks that were running on the previous leader are pending again. It must
+// be called with m.mu held.
+func (m *Master) takeOver() {
+	Debug("Master: %s is now the leader with %d jobs\n", m.lease.addr, len(m.jobs))
+	m.leader = true
+	m.following = ""
+	m.workers = make(map[string]*WorkerInfo)
+	m.resume()
+}
+
+// resume merges the output of the jobs whose tasks had all completed when
+// the previous master stopped. It must be called with m.mu held.
+func (m *Master) resume() {
+	for _, j := range m.jobs {
+		if !j.finished() && j.phase() == DonePhase {
+			go m.finish(j)
+		}
+	}
+}
+
+// replicate copies the new records of the leader's log to the local log
+// and applies them. Following a new leader starts over from an empty state.
+func (m *Master) replicate(leader leaseRecord) error {
+	m.mu.Lock()
+	if leader.ID != m.following {
+		Debug("Master: Following leader %s\n", leader.Holder)
+		m.jobs = nil
+		m.workers = make(map[string]*WorkerInfo)
+		m.replicated = 0
+		m.following = leader.ID
+		if err := m.log.file.Truncate(0); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		if _, err := m.log.file.Seek(0, io.SeekStart); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+		m.notify()
+	}
+	offset := m.replicated
+	m.mu.Unlock()
+
+	client, err := rpc.DialHTTP("tcp", leader.Holder)
+	if err != nil {
+		return err
+	}
+	var reply ReadLogReply
+	err = client.Call("Master.ReadLog", &ReadLogArgs{Offset: offset}, &reply)
+	client.Close()
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if leader.ID != m.following || offset != m.replicated {
+		return nil
+	}
+	m.eligible = true
+	if len(reply.Data) == 0 {
+		return nil
+	}
+	if _, err := m.log.file.Write(reply.Data); err != nil {
+		return err
+	}
+	if err := m.log.file.Sync(); err != nil {
+		return err
+	}
+	m.replicated += int64(len(reply.Data))
+	dec := json.NewDecoder(bytes.NewReader(reply.Data))
+	for {
+		var r logRecord
+		if err := dec.Decode(&r); err == io.EOF {
+			break
+		} else if err != nil {
+			m.following = "" // Start over on the next round
+			return err
+		}
+		if err := m.apply(r); err != nil {
+			m.following = ""
+			return err
+		}
+	}
+	m.notify()
+	return nil
+}
+
+type ReadLogArgs struct {
+	Offset int64
+}
+
+type ReadLogReply struct {
+	Data []byte // Whole records following Offset, empty when up to date
+}
+
+// ReadLog returns the records of the leader's log from a byte offset, for
+// the standby masters to replicate
+func (m *Master) ReadLog(args *ReadLogArgs, reply *ReadLogReply) error {
+	m.mu.Lock()
+	leading, path := m.leading(), m.config.LogPath
+	m.mu.Unlock()
+	if !leading || m.log == nil {
+		return ErrNotLeader
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// Only send whole records, the last one may still be being written. A
+	// chunk without a whole record is grown until it holds one.
+	for size := maxLogChunk; ; size *= 2 {
+		data := make([]byte, size)
+		n, err := file.ReadAt(data, args.Offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		end := bytes.LastIndexByte(data[:n], '\n') + 1
+		if end > 0 || n < size {
+			reply.Data = data[:end]
+			return nil
+		}
+	}
+}
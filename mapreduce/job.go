@@ -0,0 +1,277 @@
+package mapreduce
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// JobSpec describes a job submitted to a master
+type JobSpec struct {
+	Name        string
+	App         string // Application registered on the workers
+	Files       []string
+	NReduce     int
+	Partitioner string // See ParsePartitioner, hash partitioning when empty
+	SplitSize   int64  // Split input files in map tasks of about this many bytes, 0 for one task per file
+	// MemoryBudget is the number of bytes a reduce task may sort in memory
+	// before spilling to disk, see Options.MemoryBudget
+	MemoryBudget int64
+}
+
+// validate checks the parts of a spec the master can check on its own; the
+// application and a custom partitioner only have to be registered on the
+// workers
+func (spec JobSpec) validate() error {
+	if err := checkJobName(spec.Name); err != nil {
+		return err
+	}
+	if spec.App == "" {
+		return fmt.Errorf("job %q has no application", spec.Name)
+	}
+	if len(spec.Files) == 0 {
+		return fmt.Errorf("job %q has no input files", spec.Name)
+	}
+	if spec.NReduce < 1 {
+		return fmt.Errorf("job %q needs at least one reduce task", spec.Name)
+	}
+	if err := checkPartitioner(spec.Partitioner); err != nil {
+		return fmt.Errorf("job %q: %v", spec.Name, err)
+	}
+	return nil
+}
+
+// validJobName matches the job names allowed by checkJobName
+var validJobName = regexp.MustCompile(`^[A-Za-z0-9_.]+$`)
+
+// checkJobName rejects the job names that are not file name parts: the
+// files of a job are named after it, see ReduceName and AnsName. Without
+// "-" in job names, the files of a job cannot be taken for the files of
+// another one, such as MergeName("a", 0) for AnsName("a-res-0").
+func checkJobName(name string) error {
+	if name == "" {
+		return fmt.Errorf("job has no name")
+	}
+	if !validJobName.MatchString(name) || strings.Contains(name, "..") {
+		return fmt.Errorf("job name %q may only contain letters, digits, _ and single dots", name)
+	}
+	return nil
+}
+
+// JobState is the lifecycle state of a job in the master's queue
+type JobState string
+
+const (
+	JobQueued    JobState = "queued"  // Waiting for its first task to be assigned
+	JobRunning   JobState = "running" // Tasks assigned, output not merged yet
+	JobDone      JobState = "done"    // Output merged in AnsName(job)
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// JobStatus is the state of a job as reported by the master
+type JobStatus struct {
+	Name       string
+	App        string
+	State      JobState
+	Phase      JobPhase
+	TasksDone  int
+	TotalTasks int
+	Output     string // Absolute path of the result once the job is done
+	Error      string // Why the job failed
+	ErrorKind  string // Kind of the task error that made it fail, such as ErrMissingInput
+	Submitted  time.Time
+	Started    time.Time
+	Finished   time.Time
+}
+
+// job is a job known to the master, with its own task table. Task IDs are
+// indexes in tasks: map tasks first, then reduce tasks.
+type job struct {
+	spec        JobSpec
+	state       JobState
+	tasks       []Task
+	nMap        int
+	tasksDone   int
+	err         string
+	errKind     string // Kind of the task error that made the job fail, see errorKind
+	submittedAt time.Time
+	startedAt   time.Time
+	finishedAt  time.Time
+}
+
+// splitInputs returns the splits of the input files of a job, one map task
+// each, or an error if one of the files cannot be read
+func splitInputs(spec JobSpec) ([]Split, error) {
+	var splits []Split
+	for _, file := range spec.Files {
+		// The workers read the inputs under the same paths: every attempt
+		// of a map task would fail on a file the master cannot read
+		if err := checkReadable(file); err != nil {
+			return nil, fmt.Errorf("job %q: %w: %w", spec.Name, ErrMissingInput, err)
+		}
+		fileSplits, err := SplitFile(file, spec.SplitSize)
+		if err != nil {
+			return nil, fmt.Errorf("job %q: %w: %w", spec.Name, ErrMissingInput, err)
+		}
+		splits = append(splits, fileSplits...)
+	}
+	return splits, nil
+}
+
+// checkReadable checks that file is a regular file that can be opened for
+// reading
+func checkReadable(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("input %s is a directory", file)
+	}
+	return nil
+}
+
+// newJob creates the task table of a job from the splits of its input
+func newJob(spec JobSpec, splits []Split, now time.Time) *job {
+	j := &job{spec: spec, state: JobQueued, submittedAt: now}
+
+	// Initialize map tasks, one per split
+	j.nMap = len(splits)
+	for i, split := range splits {
+		j.tasks = append(j.tasks, Task{
+			ID:            i,
+			Type:          MapTask,
+			JobName:       spec.Name,
+			App:           spec.App,
+			Partitioner:   spec.Partitioner,
+			File:          split.File,
+			Offset:        split.Offset,
+			Length:        split.Length,
+			MapTaskNumber: i,
+			NReduce:       spec.NReduce,
+			NMap:          j.nMap,
+			Status:        "pending",
+		})
+	}
+
+	// Initialize reduce tasks, each of them needs the output of every map task
+	mapIDs := make([]int, j.nMap)
+	for i := range mapIDs {
+		mapIDs[i] = i
+	}
+	for i := 0; i < spec.NReduce; i++ {
+		j.tasks = append(j.tasks, Task{
+			ID:               j.nMap + i,
+			Type:             ReduceTask,
+			JobName:          spec.Name,
+			App:              spec.App,
+			Partitioner:      spec.Partitioner,
+			ReduceTaskNumber: i,
+			NReduce:          spec.NReduce,
+			NMap:             j.nMap,
+			MemoryBudget:     spec.MemoryBudget,
+			DependsOn:        mapIDs,
+			Status:           "pending",
+		})
+	}
+	return j
+}
+
+// finished reports whether the job has left the queue for good
+func (j *job) finished() bool {
+	return j.state == JobDone || j.state == JobFailed || j.state == JobCancelled
+}
+
+// ready reports whether every dependency of task has completed
+func (j *job) ready(task Task) bool {
+	for _, id := range task.DependsOn {
+		if j.tasks[id].Status != "completed" {
+			return false
+		}
+	}
+	return true
+}
+
+// reset makes completed task i pending again once its output is lost
+func (j *job) reset(i int) {
+	task := &j.tasks[i]
+	if task.Status != "completed" {
+		return
+	}
+	for k := range task.Attempts {
+		if task.Attempts[k].Status == "completed" {
+			task.Attempts[k].Status = "lost"
+		}
+	}
+	task.Status = "pending"
+	task.WorkerID = ""
+	task.Committed = ""
+	task.Location = ""
+	task.Counters = Counters{}
+	j.tasksDone--
+}
+
+// mapOutputs returns the tags of the committed attempts of the map tasks
+// and the shuffle addresses serving their output, by map task number
+func (j *job) mapOutputs() (tags, locations []string) {
+	tags = make([]string, j.nMap)
+	locations = make([]string, j.nMap)
+	for i := range tags {
+		tags[i] = j.tasks[i].Committed
+		locations[i] = j.tasks[i].Location
+	}
+	return tags, locations
+}
+
+// phase returns the current phase of the job
+func (j *job) phase() JobPhase {
+	if j.tasksDone == len(j.tasks) {
+		return DonePhase
+	}
+	for _, task := range j.tasks {
+		if task.Type == MapTask && task.Status != "completed" {
+			return MapPhase
+		}
+	}
+	return ReducePhase
+}
+
+// Err returns a *JobError if the job failed or was cancelled, nil otherwise
+func (status JobStatus) Err() error {
+	if status.State != JobFailed && status.State != JobCancelled {
+		return nil
+	}
+	return &JobError{Job: status.Name, State: status.State, Reason: status.Error, Kind: kindError(status.ErrorKind)}
+}
+
+func (j *job) status() JobStatus {
+	status := JobStatus{
+		Name:       j.spec.Name,
+		App:        j.spec.App,
+		State:      j.state,
+		Phase:      j.phase(),
+		TasksDone:  j.tasksDone,
+		TotalTasks: len(j.tasks),
+		Error:      j.err,
+		ErrorKind:  j.errKind,
+		Submitted:  j.submittedAt,
+		Started:    j.startedAt,
+		Finished:   j.finishedAt,
+	}
+	if j.state == JobDone {
+		status.Output = AnsName(j.spec.Name)
+		if abs, err := filepath.Abs(status.Output); err == nil {
+			status.Output = abs
+		}
+	}
+	return status
+}
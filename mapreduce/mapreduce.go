@@ -1,10 +1,13 @@
 package mapreduce
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
 	"hash/fnv"
-	"io/ioutil"
+	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 )
@@ -34,15 +37,26 @@ func AnsName(jobName string) string {
 	return prefix + jobName
 }
 
-// clean all intermediary files generated for a job
+// clean all intermediary files generated for a job, including those of
+// every task attempt
 func CleanIntermediary(jobName string, nMap, nReduce int) {
+	cleanIntermediary("", jobName, nMap, nReduce)
+}
+
+// cleanIntermediary is CleanIntermediary for the files in dir
+func cleanIntermediary(dir, jobName string, nMap, nReduce int) {
 	// Supprimer les fichiers intermédiaires produits les tâches map
+	names := make(map[string]bool)
 	for reduceTNbr := 0; reduceTNbr < nReduce; reduceTNbr++ {
 		for mapTNbr := 0; mapTNbr < nMap; mapTNbr++ {
-			os.Remove(ReduceName(jobName, mapTNbr, reduceTNbr))
+			names[filepath.Join(dir, ReduceName(jobName, mapTNbr, reduceTNbr))] = true
 		}
-		os.Remove(MergeName(jobName, reduceTNbr))
+		names[filepath.Join(dir, MergeName(jobName, reduceTNbr))] = true
 	}
+	for name := range names {
+		os.Remove(name)
+	}
+	removeAttempts(dir, jobName, names)
 }
 
 // Is used to associate to each key a unique reduce file
@@ -52,6 +66,104 @@ func ihash(s string) uint32 {
 	return h.Sum32()
 }
 
+// EmitFunc outputs a key/value pair
+type EmitFunc func(key, value string)
+
+// RecordMapFunc is the streaming form of a map function: it is called once
+// per input record and passes its pairs to emit, so that neither the input
+// nor the output of a map task has to fit in memory
+type RecordMapFunc func(record string, emit EmitFunc)
+
+// MapAdapter turns a map function returning a slice of pairs into a
+// RecordMapFunc applied to every record. Such map functions expect the
+// contents of a whole split: DoMap, Sequential and apps with a Map function
+// read their input with NewSplitReader, so that the adapted function is
+// called once per split.
+func MapAdapter(mapF func(contents string) []KeyValue) RecordMapFunc {
+	return func(record string, emit EmitFunc) {
+		for _, kv := range mapF(record) {
+			emit(kv.Key, kv.Value)
+		}
+	}
+}
+
+// ValueIterator walks the values of one key in a reduce task. Next returns
+// false once the values are exhausted.
+type ValueIterator interface {
+	Next() (string, bool)
+}
+
+// IterReduceFunc is the streaming form of a reduce function: it is called
+// once per key, in sorted key order, reads the values of the key from an
+// iterator instead of a slice, and may emit any number of output pairs
+type IterReduceFunc func(key string, values ValueIterator, emit EmitFunc)
+
+// ReduceAdapter turns a reduce function taking a slice of values into an
+// IterReduceFunc emitting a single pair per key
+func ReduceAdapter(reduceF func(key string, values []string) string) IterReduceFunc {
+	return func(key string, values ValueIterator, emit EmitFunc) {
+		var all []string
+		for value, ok := values.Next(); ok; value, ok = values.Next() {
+			all = append(all, value)
+		}
+		emit(key, reduceF(key, all))
+	}
+}
+
+// combineBufferRecords is the number of pairs a map task with a combiner
+// buffers before combining and writing them out
+const combineBufferRecords = 1 << 16
+
+// Options are the optional settings of a map or reduce task
+type Options struct {
+	// Combiner, when set, merges the values of each key emitted by a map
+	// task before they are written to the intermediate files. It must be
+	// safe to apply the reduce function to its output again.
+	Combiner func(key string, values []string) string
+	// Partitioner chooses the reduce task of each key, HashPartitioner{}
+	// when nil
+	Partitioner Partitioner
+	// SplitSize makes SequentialWithOptions cut its input files in splits
+	// of about that many bytes, see SplitFile. Zero keeps whole files.
+	SplitSize int64
+	// Reader cuts the input of map tasks in records, NewLineReader when nil
+	Reader ReaderFunc
+	// MemoryBudget is the number of bytes of pairs a reduce task sorts in
+	// memory before spilling them to disk, 64 MiB when zero
+	MemoryBudget int64
+	// AttemptTag, set by workers, makes a task write its output files
+	// under AttemptName(name, AttemptTag) and leave them for the master to
+	// commit. Without a tag, the task renames its output files to their
+	// final names itself once it succeeds.
+	AttemptTag string
+	// MapAttempts are the tags of the committed attempts of the map tasks,
+	// by map task number, whose intermediate files a reduce task reads.
+	// The final names are read when there is no tag.
+	MapAttempts []string
+	// Dir is the directory of the files written by a task and of the
+	// intermediate files it reads, the current directory when empty
+	Dir string
+	// OpenIntermediate, when set, opens the intermediate file <name> of
+	// map task mapTask for a reduce task instead of reading it from Dir,
+	// see ShuffleFetcher
+	OpenIntermediate func(mapTask int, name string) (io.ReadCloser, error)
+	// AfterWrite, when set, is called after each record the task writes,
+	// with the records written so far flushed to the files. Fault injection
+	// uses it to stop a worker in the middle of a write.
+	AfterWrite func(written int64)
+}
+
+// Counters are the record counts of a task, reported to the master
+type Counters struct {
+	MapInputRecords      int64 // Records fed to the map function
+	MapOutputRecords     int64 // Pairs emitted by the map function
+	CombineInputRecords  int64 // Pairs fed to the combiner
+	CombineOutputRecords int64 // Pairs produced by the combiner
+	ReduceInputRecords   int64 // Pairs read from the intermediate files
+	ReduceOutputRecords  int64 // Pairs written by the reduce function
+	SpilledRuns          int64 // Sorted runs a reduce task spilled to disk
+}
+
 // doMap applique la fonction mapF, et sauvegarde les résultats.
 // A COMPLETER
 func DoMap(
@@ -60,44 +172,178 @@ func DoMap(
 	inFile string,
 	nReduce int,
 	mapF func(contents string) []KeyValue,
-) {
-	// Lire le contenu du fichier d’entrée
-	content, err := ioutil.ReadFile(inFile)
-	if err != nil {
-		panic("Erreur lecture fichier d'entrée: " + err.Error())
+) error {
+	_, err := DoMapWithOptions(jobName, mapTaskNumber, Split{File: inFile}, nReduce, MapAdapter(mapF), Options{Reader: NewSplitReader})
+	return err
+}
+
+// DoMapWithOptions is DoMap over a split of an input file, with a streaming
+// map function and optional settings; it returns the record counters of the
+// task. Errors are *TaskError values.
+func DoMapWithOptions(
+	jobName string,
+	mapTaskNumber int,
+	split Split,
+	nReduce int,
+	mapF RecordMapFunc,
+	opts Options,
+) (counters Counters, err error) {
+	fail := func(file string, kind, err error) error {
+		return &TaskError{Op: "map", Job: jobName, Task: mapTaskNumber, File: file, Kind: kind, Err: err}
 	}
 
-	// Appliquer mapF pour obtenir les paires clé/valeur
-	kvs := mapF(string(content))
+	newReader := opts.Reader
+	if newReader == nil {
+		newReader = NewLineReader
+	}
+	reader, err := newReader(split)
+	if err != nil {
+		return counters, openError("map", jobName, mapTaskNumber, split.File, err)
+	}
+	defer reader.Close()
 
-	// Créer un tableau d'encodeurs JSON, un par fichier reduce
-	encoders := make([]*json.Encoder, nReduce)
+	// Créer et ouvrir les fichiers intermédiaires de la tentative pour
+	// chaque reduce
+	tag := opts.AttemptTag
+	if tag == "" {
+		tag = localTag()
+	}
+	names := make([]string, nReduce)
 	files := make([]*os.File, nReduce)
-
-	// Créer et ouvrir les fichiers intermédiaires pour chaque reduce
+	writers := make([]*bufio.Writer, nReduce)
+	encoders := make([]*json.Encoder, nReduce)
+	defer func() {
+		for _, file := range files {
+			if file != nil {
+				file.Close()
+			}
+		}
+		if err != nil {
+			discardFiles(names, tag)
+		}
+	}()
 	for r := 0; r < nReduce; r++ {
-		fileName := ReduceName(jobName, mapTaskNumber, r)
-		file, err := os.Create(fileName)
+		names[r] = filepath.Join(opts.Dir, ReduceName(jobName, mapTaskNumber, r))
+		file, err := os.Create(AttemptName(names[r], tag))
 		if err != nil {
-			panic("Erreur création fichier reduce: " + err.Error())
+			return counters, fail(AttemptName(names[r], tag), ErrWriteFailed, err)
 		}
 		files[r] = file
-		encoders[r] = json.NewEncoder(file)
+		writers[r] = bufio.NewWriter(file)
+		encoders[r] = json.NewEncoder(writers[r])
+	}
+	// The first write or partitioning error is kept and stops the task
+	// after the current record, emit cannot return it to the map function
+	var writeErr error
+	var written int64
+	write := func(r int, kv KeyValue) {
+		if writeErr != nil {
+			return
+		}
+		if err := encoders[r].Encode(&kv); err != nil {
+			writeErr = fail(AttemptName(names[r], tag), ErrWriteFailed, err)
+			return
+		}
+		written++
+		if opts.AfterWrite != nil {
+			writers[r].Flush()
+			opts.AfterWrite(written)
+		}
 	}
 
-	// Pour chaque paire, calculer le reduceTask correspondant et l’écrire
-	for _, kv := range kvs {
-		r := int(ihash(kv.Key)) % nReduce
-		err := encoders[r].Encode(&kv)
+	// With a combiner, pairs are buffered per reduce task and combined
+	// every combineBufferRecords pairs
+	partitioner := opts.Partitioner
+	if partitioner == nil {
+		partitioner = HashPartitioner{}
+	}
+	buffers := make([][]KeyValue, nReduce)
+	buffered := 0
+	flush := func() {
+		for r := range buffers {
+			counters.CombineInputRecords += int64(len(buffers[r]))
+			for _, kv := range combine(buffers[r], opts.Combiner) {
+				write(r, kv)
+				counters.CombineOutputRecords++
+			}
+			buffers[r] = buffers[r][:0]
+		}
+		buffered = 0
+	}
+	emit := func(key, value string) {
+		counters.MapOutputRecords++
+		r := partitioner.Partition(key, nReduce)
+		if r < 0 || r >= nReduce {
+			if writeErr == nil {
+				writeErr = fail("", nil, fmt.Errorf("partitioner put key %q in reduce task %d of %d", key, r, nReduce))
+			}
+			return
+		}
+		if opts.Combiner == nil {
+			write(r, KeyValue{Key: key, Value: value})
+			return
+		}
+		buffers[r] = append(buffers[r], KeyValue{Key: key, Value: value})
+		buffered++
+		if buffered >= combineBufferRecords {
+			flush()
+		}
+	}
+
+	// Appliquer mapF à chaque enregistrement du split
+	for writeErr == nil {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return counters, fail(split.File, nil, err)
+		}
+		counters.MapInputRecords++
+		mapF(record, emit)
+	}
+	if opts.Combiner != nil {
+		flush()
+	}
+	if writeErr != nil {
+		return counters, writeErr
+	}
+
+	for r := range writers {
+		err := writers[r].Flush()
+		if closeErr := files[r].Close(); err == nil {
+			err = closeErr
+		}
+		files[r] = nil
 		if err != nil {
-			panic("Erreur écriture kv dans fichier intermédiaire: " + err.Error())
+			return counters, fail(AttemptName(names[r], tag), ErrWriteFailed, err)
 		}
 	}
+	if opts.AttemptTag == "" {
+		if err := commitFiles(names, tag); err != nil {
+			return counters, fail("", ErrWriteFailed, err)
+		}
+	}
+	return counters, nil
+}
+
+// combine groups the pairs of a partition by key and applies combineF to
+// each group, returning one pair per key in sorted key order
+func combine(kvs []KeyValue, combineF func(key string, values []string) string) []KeyValue {
+	values := make(map[string][]string)
+	for _, kv := range kvs {
+		values[kv.Key] = append(values[kv.Key], kv.Value)
+	}
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-	// Fermer les fichiers
-	for _, f := range files {
-		f.Close()
+	combined := make([]KeyValue, 0, len(keys))
+	for _, k := range keys {
+		combined = append(combined, KeyValue{Key: k, Value: combineF(k, values[k])})
 	}
+	return combined
 }
 
 // doReduce effectue une tâche de réduction en lisant les fichiers
@@ -109,74 +355,210 @@ func DoReduce(
 	reduceTaskNumber int,
 	nMap int,
 	reduceF func(key string, values []string) string,
-) {
-	// Map de regroupement des valeurs par clé
-	keyValues := make(map[string][]string)
+) error {
+	_, err := DoReduceWithOptions(jobName, reduceTaskNumber, nMap, ReduceAdapter(reduceF), Options{})
+	return err
+}
+
+// DoReduceWithOptions is DoReduce with a streaming reduce function and
+// optional settings; it returns the record counters of the task. The pairs
+// of the task are sorted within opts.MemoryBudget, spilling sorted runs to
+// disk and merging them, and the values of each key are streamed from the
+// merge to reduceF. Errors are *TaskError values.
+func DoReduceWithOptions(
+	jobName string,
+	reduceTaskNumber int,
+	nMap int,
+	reduceF IterReduceFunc,
+	opts Options,
+) (counters Counters, err error) {
+	fail := func(file string, kind, err error) error {
+		return &TaskError{Op: "reduce", Job: jobName, Task: reduceTaskNumber, File: file, Kind: kind, Err: err}
+	}
+
+	sorter := newSorter(opts.Dir, jobName, reduceTaskNumber, opts.MemoryBudget)
+	defer sorter.cleanup()
 
 	// Lire chaque fichier intermédiaire produit par les tâches Map
 	for i := 0; i < nMap; i++ {
 		fileName := ReduceName(jobName, i, reduceTaskNumber)
-		// Ouvrir le fichier pour la tâche de mappage i
-		file, err := os.Open(fileName)
+		if i < len(opts.MapAttempts) {
+			fileName = AttemptName(fileName, opts.MapAttempts[i])
+		}
+		// Ouvrir le fichier pour la tâche de mappage i, localement ou
+		// auprès du worker qui l'a produit
+		var file io.ReadCloser
+		if opts.OpenIntermediate != nil {
+			file, err = opts.OpenIntermediate(i, fileName)
+		} else {
+			fileName = filepath.Join(opts.Dir, fileName)
+			file, err = os.Open(fileName)
+		}
 		if err != nil {
-			panic("Erreur ouverture fichier intermédiaire: " + err.Error())
+			return counters, lostOutput(openError("reduce", jobName, reduceTaskNumber, fileName, err), i)
 		}
 		// Lire les paires clé-valeur du fichier
-		// Ajouter la valeur à la liste de valeurs pour cette clé
-		decoder := json.NewDecoder(file)
-		var kv KeyValue
-		for decoder.Decode(&kv) == nil {
-			keyValues[kv.Key] = append(keyValues[kv.Key], kv.Value)
+		decoder := json.NewDecoder(bufio.NewReader(file))
+		for {
+			var kv KeyValue
+			if err := decoder.Decode(&kv); err == io.EOF {
+				break
+			} else if err != nil {
+				file.Close()
+				return counters, lostOutput(fail(fileName, ErrCorruptIntermediate, err), i)
+			}
+			counters.ReduceInputRecords++
+			if err := sorter.add(kv); err != nil {
+				file.Close()
+				return counters, fail("", ErrWriteFailed, err)
+			}
 		}
 		file.Close()
 	}
+	counters.SpilledRuns = int64(len(sorter.spills))
 
-	// Récupérer les clés triées pour un ordre déterministe
-	var keys []string
-	for k := range keyValues {
-		keys = append(keys, k)
+	// Fusionner les séquences triées pour parcourir les clés dans l'ordre
+	runs, err := sorter.runs()
+	if err != nil {
+		return counters, fail("", ErrMissingInput, err)
 	}
-	sort.Strings(keys)
+	merger, err := newMerger(runs)
+	if err != nil {
+		return counters, fail("", ErrCorruptIntermediate, err)
+	}
+	defer merger.close()
 
-	// Ouvrir le fichier de sortie pour la tâche de réduction
-	// utiliser MergeName
-	outputFile, err := os.Create(MergeName(jobName, reduceTaskNumber))
+	// Ouvrir le fichier de sortie de la tentative pour la tâche de
+	// réduction, utiliser MergeName
+	tag := opts.AttemptTag
+	if tag == "" {
+		tag = localTag()
+	}
+	outputName := AttemptName(filepath.Join(opts.Dir, MergeName(jobName, reduceTaskNumber)), tag)
+	outputFile, err := os.Create(outputName)
 	if err != nil {
-		panic("Erreur création fichier résultat reduce: " + err.Error())
+		return counters, fail(outputName, ErrWriteFailed, err)
 	}
-	defer outputFile.Close()
+	defer func() {
+		outputFile.Close()
+		if err != nil {
+			os.Remove(outputName)
+		}
+	}()
 
 	// Créer un encodeur JSON pour le fichier de sortie
-	enc := json.NewEncoder(outputFile)
+	writer := bufio.NewWriter(outputFile)
+	enc := json.NewEncoder(writer)
+
+	var writeErr error
+	emit := func(key, value string) {
+		if writeErr != nil {
+			return
+		}
+		if err := enc.Encode(&KeyValue{Key: key, Value: value}); err != nil {
+			writeErr = fail(outputName, ErrWriteFailed, err)
+			return
+		}
+		counters.ReduceOutputRecords++
+		if opts.AfterWrite != nil {
+			writer.Flush()
+			opts.AfterWrite(counters.ReduceOutputRecords)
+		}
+	}
 
 	// Réduire chaque clé et écrire le résultat
-	// Appliquer la fonction de réduction à chaque clé
-	for _, key := range keys {
-		// Appliquer reduceF pour réduire les valeurs associées à cette clé
-		// Écrire la clé et la valeur réduite dans le fichier de sortie
-		reducedValue := reduceF(key, keyValues[key])
-		err := enc.Encode(&KeyValue{Key: key, Value: reducedValue})
-		if err != nil {
-			panic("Erreur encodage résultat reduce: " + err.Error())
+	kv, err := merger.next()
+	for err == nil && writeErr == nil {
+		// Les valeurs consécutives de la même clé sont lues au fil de l'eau
+		values := &valueIterator{merger: merger, key: kv.Key, head: kv.Value, hasHead: true}
+		reduceF(kv.Key, values, emit)
+		kv, err = values.skip()
+	}
+	if writeErr != nil {
+		return counters, writeErr
+	}
+	if err != io.EOF {
+		return counters, fail("", ErrCorruptIntermediate, err)
+	}
+	if err := writer.Flush(); err != nil {
+		return counters, fail(outputName, ErrWriteFailed, err)
+	}
+	if err := outputFile.Close(); err != nil {
+		return counters, fail(outputName, ErrWriteFailed, err)
+	}
+	if opts.AttemptTag == "" {
+		if err := commitFiles([]string{filepath.Join(opts.Dir, MergeName(jobName, reduceTaskNumber))}, tag); err != nil {
+			return counters, fail("", ErrWriteFailed, err)
 		}
 	}
+	return counters, nil
 }
 
 // concatFiles concatène plusieurs fichiers en un seul
-func Sequential(jobName string, files []string, nReduce int, mapF func(string) []KeyValue, reduceF func(string, []string) string) {
-	for i, file := range files {
-		DoMap(jobName, i, file, nReduce, mapF)
+func Sequential(jobName string, files []string, nReduce int, mapF func(string) []KeyValue, reduceF func(string, []string) string) error {
+	return SequentialWithOptions(jobName, files, nReduce, MapAdapter(mapF), ReduceAdapter(reduceF), Options{Reader: NewSplitReader})
+}
+
+// splitFiles cuts every input file in splits of about splitSize bytes
+func splitFiles(files []string, splitSize int64) ([]Split, error) {
+	var splits []Split
+	for _, file := range files {
+		fileSplits, err := SplitFile(file, splitSize)
+		if err != nil {
+			return nil, err
+		}
+		splits = append(splits, fileSplits...)
+	}
+	return splits, nil
+}
+
+// SequentialWithOptions is Sequential with the options applied to every
+// map and reduce task. It stops at the first task that fails. The result
+// is written in opts.Dir, with the files of the tasks.
+func SequentialWithOptions(jobName string, files []string, nReduce int, mapF RecordMapFunc, reduceF IterReduceFunc, opts Options) error {
+	splits, err := splitFiles(files, opts.SplitSize)
+	if err != nil {
+		var file string
+		if pathErr, ok := err.(*os.PathError); ok {
+			file = pathErr.Path
+		}
+		return openError("map", jobName, 0, file, err)
+	}
+	for i, split := range splits {
+		if _, err := DoMapWithOptions(jobName, i, split, nReduce, mapF, opts); err != nil {
+			return err
+		}
 	}
 
 	for i := 0; i < nReduce; i++ {
-		DoReduce(jobName, i, len(files), reduceF)
+		if _, err := DoReduceWithOptions(jobName, i, len(splits), reduceF, opts); err != nil {
+			return err
+		}
 	}
 
 	// Merge results
-	resFiles := make([]string, 0, nReduce)
-	for i := 0; i < nReduce; i++ {
-		resFiles = append(resFiles, MergeName(jobName, i))
+	return mergeOutput(opts.Dir, jobName, nReduce, func(reduceTask int) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(opts.Dir, MergeName(jobName, reduceTask)))
+	})
+}
+
+// mergeOutput concatenates the output files of the reduce tasks of a job,
+// opened with open, in AnsName(jobName) in dir, which is replaced in one
+// step
+func mergeOutput(dir, jobName string, nReduce int, open func(reduceTask int) (io.ReadCloser, error)) error {
+	tag := localTag()
+	output := filepath.Join(dir, AnsName(jobName))
+	err := concatFiles(AttemptName(output, tag), nReduce, open)
+	if err == nil {
+		err = commitFiles([]string{output}, tag)
+	}
+	if err != nil {
+		discardFiles([]string{output}, tag)
+		kind := ErrWriteFailed
+		if os.IsNotExist(err) {
+			kind = ErrMissingInput
+		}
+		return &TaskError{Op: "merge", Job: jobName, Kind: kind, Err: err}
 	}
-	err := concatFiles(AnsName(jobName), resFiles)
-	CheckError(err, "cannot merge output files: %v\n")
+	return nil
 }
@@ -3,11 +3,16 @@ package mapreduce
 // Sequential runs map and reduce tasks sequentially, waiting for each task to
 // complete before scheduling the next.
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
 	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 )
@@ -19,6 +24,18 @@ const (
 	MapTask    TaskType = "map"
 	ReduceTask TaskType = "reduce"
 	IdleTask   TaskType = "idle"
+	ExitTask   TaskType = "exit" // The master is shutting down, the worker stops
+)
+
+// JobPhase is the stage a job has reached. Reduce tasks depend on every map
+// task, so a job moves from the map phase to the reduce phase only once all
+// map tasks are completed.
+type JobPhase string
+
+const (
+	MapPhase    JobPhase = "map"
+	ReducePhase JobPhase = "reduce"
+	DonePhase   JobPhase = "done"
 )
 
 // Task représente une tâche de map ou de reduce
@@ -26,186 +43,1084 @@ type Task struct {
 	ID               int
 	Type             TaskType
 	JobName          string
+	App              string // Name of the registered App to run
+	Partitioner      string // Partitioner spec, see ParsePartitioner
 	File             string // For map tasks
+	Offset           int64  // Byte range of File read by a map task, see Split
+	Length           int64
 	MapTaskNumber    int
 	ReduceTaskNumber int
 	NReduce          int
 	NMap             int
+	MemoryBudget     int64  // For reduce tasks, see JobSpec.MemoryBudget
+	DependsOn        []int  // IDs of the tasks that must be completed first
 	Status           string // "pending", "running", "completed"
 	WorkerID         string
 	StartTime        time.Time
+	Attempts         []Attempt // Every execution of the task, backups included
+	Attempt          int       // Attempt a worker is asked to run, set in GetTask replies
+	Tag              string    // Tag of that attempt, see Options.AttemptTag
+	MapAttempts      []string  // For reduce tasks in GetTask replies, see Options.MapAttempts
+	Committed        string    // Tag of the attempt whose output was committed
+	Location         string    // Shuffle address serving the committed output, empty on a shared directory
+	MapLocations     []string  // For reduce tasks in GetTask replies, see ShuffleFetcher
+	Counters         Counters  // Record counts of the winning attempt
+	Failures         int       // Attempts that reported an error, see MasterConfig.MaxAttempts
+	Recomputed       []int     // For reduce tasks, map tasks that ran again because this task lost their output
+}
+
+// Attempt is one execution of a task on a worker. A task may have a backup
+// attempt running next to the original one; the first to report wins.
+type Attempt struct {
+	ID        int
+	WorkerID  string
+	Backup    bool
+	Status    string // "running", "completed", "superseded", "lost", "failed"
+	Error     string // Why a failed attempt failed
+	Tag       string // Names the output files of the attempt, see AttemptName
+	StartTime time.Time
+	EndTime   time.Time
 }
 
 // WorkerInfo tracks worker status
 type WorkerInfo struct {
-	ID      string
-	Status  string // "idle", "working", "crashed"
-	Address string
+	ID       string
+	Status   string    // "idle", "working", "crashed", "exited"
+	Address  string    // Address of the shuffle server of the worker, if any
+	Slots    int       // Tasks the worker runs at once
+	Running  []TaskRef // Attempts the worker is running
+	LastSeen time.Time // Last heartbeat or task request
+}
+
+// TaskRef names an attempt of a task. Masters number attempts from 1
+// again after a recovery or a failover: only the tag tells their attempts
+// apart.
+type TaskRef struct {
+	JobName string
+	TaskID  int
+	Attempt int
+	Tag     string
+}
+
+// started records that the worker runs a new attempt
+func (w *WorkerInfo) started(ref TaskRef) {
+	w.Running = append(w.Running, ref)
+	w.updateStatus()
 }
 
-// Master gere les tasks et les workers
+// stopped records that the worker no longer runs an attempt
+func (w *WorkerInfo) stopped(ref TaskRef) {
+	for i, running := range w.Running {
+		if running == ref {
+			w.Running = append(w.Running[:i], w.Running[i+1:]...)
+			break
+		}
+	}
+	w.updateStatus()
+}
+
+// updateStatus derives the status of a live worker from its running
+// attempts
+func (w *WorkerInfo) updateStatus() {
+	if w.Status == "crashed" || w.Status == "exited" {
+		return
+	}
+	if len(w.Running) > 0 {
+		w.Status = "working"
+	} else {
+		w.Status = "idle"
+	}
+}
+
+// MasterConfig holds the failure detection settings of a master
+type MasterConfig struct {
+	// HeartbeatInterval is how often workers are expected to send a
+	// heartbeat, one second when not positive
+	HeartbeatInterval time.Duration
+	// MissedHeartbeats is the number of intervals without news from a worker
+	// after which it is marked crashed and its running tasks are re-queued,
+	// 3 when not positive
+	MissedHeartbeats int
+	// SpeculationFactor launches a backup attempt for a task running more
+	// than this many times the median duration of the completed tasks of its
+	// phase, once no task of that phase is left pending. Zero disables it.
+	SpeculationFactor float64
+	// MaxAttempts is the number of failed attempts of a task, as reported
+	// with ReportTaskFailed, after which its job fails. Attempts lost with
+	// their worker do not count, nor do reduce attempts losing the output
+	// of a map task that did not run again for them yet. Zero means no
+	// limit.
+	MaxAttempts int
+	// LogPath is the write-ahead log of the master, see RecoverMaster. The
+	// master keeps no log when it is empty.
+	LogPath string
+	// RPCAddr and HTTPAddr are the addresses of the RPC server and of the
+	// dashboard, ":1234" and ":8080" when empty. With port 0 the system
+	// picks a free port, see Master.RPCAddr and Master.HTTPAddr.
+	RPCAddr  string
+	HTTPAddr string
+	// LeasePath is a lease file shared by a leader and its standby masters,
+	// which replicate its log and take over when it stops renewing the lease
+	// for LeaseDuration. A master without lease file always leads. The
+	// masters must have a LogPath each and RPC addresses their peers can
+	// dial. Replication is asynchronous: the standbys read the log a few
+	// times per LeaseDuration, so what the leader acknowledged just before
+	// it stopped, such as a SubmitJob, may be missing on the new leader.
+	LeasePath     string
+	LeaseDuration time.Duration
+	// Linger is how long Run keeps the servers up once the jobs are done,
+	// for the dashboard and to tell the workers to exit
+	Linger time.Duration
+	// Clock tells the time for heartbeats, stragglers and waits, the real
+	// clock when nil. The lease of MasterConfig.LeasePath always goes by
+	// the real clock, which the other masters share.
+	Clock Clock
+}
+
+// DefaultMasterConfig returns the settings used by NewMaster
+func DefaultMasterConfig() MasterConfig {
+	return MasterConfig{
+		HeartbeatInterval: time.Second,
+		MissedHeartbeats:  3,
+		SpeculationFactor: 2,
+		MaxAttempts:       4,
+		RPCAddr:           ":1234",
+		HTTPAddr:          ":8080",
+		LeaseDuration:     defaultLeaseDuration,
+		Linger:            30 * time.Second,
+	}
+}
+
+// defaultLeaseDuration is the lease duration of masters sharing a lease
+// file when MasterConfig.LeaseDuration is not set
+const defaultLeaseDuration = 3 * time.Second
+
+// Master gere les tasks et les workers. It runs the jobs submitted to it in
+// submission order, handing out the tasks of a job as soon as the jobs
+// before it have no ready task left.
 type Master struct {
-	tasks      []Task
-	workers    map[string]*WorkerInfo
-	nReduce    int
-	jobName    string
-	files      []string
-	mu         sync.Mutex
-	done       chan bool
-	tasksDone  int
-	totalTasks int
-}
-
-// NewMaster initializes a new master
-func NewMaster(jobName string, files []string, nReduce int) *Master {
+	jobs    []*job // Every job submitted, finished ones included
+	workers map[string]*WorkerInfo
+	config  MasterConfig
+	clock   Clock
+	mu      sync.Mutex
+	changed chan struct{} // Closed and replaced whenever a job finishes
+	ready   chan struct{} // Closed and replaced whenever tasks may be ready, see wake
+	log     *masterLog    // nil without MasterConfig.LogPath
+
+	// Servers, each with its own listener and handlers, see Start
+	rpcListener  net.Listener
+	httpListener net.Listener
+	rpcServer    *http.Server
+	rpcHandler   *rpcHandler
+	httpServer   *http.Server
+	exiting      bool          // Workers get an ExitTask, see Shutdown
+	done         chan struct{} // Closed by Shutdown to stop the reaper and the election
+
+	// Election and replication, see elect
+	lease        *lease // nil without MasterConfig.LeasePath
+	leader       bool
+	leaseExpires time.Time
+	eligible     bool   // Whether the master may take the lease
+	following    string // ID of the leader whose log is being replicated
+	replicated   int64  // Bytes of the leader's log replicated so far
+}
+
+// NewMaster initializes a new master for a job running the application
+// registered as appName on the workers
+func NewMaster(jobName, appName string, files []string, nReduce int) (*Master, error) {
+	m, err := NewMasterWithConfig(DefaultMasterConfig())
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Submit(JobSpec{Name: jobName, App: appName, Files: files, NReduce: nReduce}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// NewMasterWithConfig initializes a master with an empty job queue and
+// explicit settings. Jobs are added with Submit or the SubmitJob RPC. An
+// existing log at config.LogPath is overwritten.
+func NewMasterWithConfig(config MasterConfig) (*Master, error) {
+	m, err := newMaster(config)
+	if err != nil {
+		return nil, err
+	}
+	if m.lease != nil {
+		_, err := os.Stat(config.LeasePath)
+		m.eligible = os.IsNotExist(err)
+	}
+	if config.LogPath != "" {
+		m.log, err = openLog(config.LogPath, os.O_TRUNC)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create master log: %w", err)
+		}
+	}
+	return m, nil
+}
+
+func newMaster(config MasterConfig) (*Master, error) {
+	// Without them, the reaper would run without pause and find every
+	// worker crashed
+	defaults := DefaultMasterConfig()
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = defaults.HeartbeatInterval
+	}
+	if config.MissedHeartbeats <= 0 {
+		config.MissedHeartbeats = defaults.MissedHeartbeats
+	}
 	m := &Master{
-		tasks:     make([]Task, 0),
-		workers:   make(map[string]*WorkerInfo),
-		nReduce:   nReduce,
-		jobName:   jobName,
-		files:     files,
-		done:      make(chan bool),
-		tasksDone: 0,
-	}
-
-	// Initialize map tasks
-	for i, file := range files {
-		m.tasks = append(m.tasks, Task{
-			ID:            i,
-			Type:          MapTask,
-			JobName:       jobName,
-			File:          file,
-			MapTaskNumber: i,
-			NReduce:       nReduce,
-			NMap:          len(files),
-			Status:        "pending",
-		})
-	}
-
-	// Initialize reduce tasks
-	for i := 0; i < nReduce; i++ {
-		m.tasks = append(m.tasks, Task{
-			ID:               len(files) + i,
-			Type:             ReduceTask,
-			JobName:          jobName,
-			ReduceTaskNumber: i,
-			NReduce:          nReduce,
-			NMap:             len(files),
-			Status:           "pending",
-		})
-	}
-
-	m.totalTasks = len(m.tasks)
-	return m
+		workers: make(map[string]*WorkerInfo),
+		config:  config,
+		clock:   clockOrReal(config.Clock),
+		changed: make(chan struct{}),
+		ready:   make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if config.LeasePath != "" {
+		if config.LogPath == "" {
+			return nil, fmt.Errorf("a master with a lease file needs a log: %w", ErrNoLog)
+		}
+		m.lease = newLease(config.LeasePath, m.rpcAddr(), config.LeaseDuration)
+	}
+	return m, nil
+}
+
+// Submit appends a job to the queue. Job names must be unique, since they
+// name the output files of the job, and the input files must be readable.
+func (m *Master) Submit(spec JobSpec) error {
+	if err := spec.validate(); err != nil {
+		return err
+	}
+	// Reading the inputs may take a while, not to be spent holding m.mu
+	splits, err := splitInputs(spec)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.leading() {
+		return ErrNotLeader
+	}
+	if m.job(spec.Name) != nil {
+		return fmt.Errorf("job %q already exists", spec.Name)
+	}
+	if err := m.record(logRecord{Op: "submit", Job: spec.Name, Spec: &spec, Splits: splits}); err != nil {
+		return err
+	}
+	j := newJob(spec, splits, m.clock.Now())
+	m.jobs = append(m.jobs, j)
+	Debug("Master: Job %s queued with %d map and %d reduce tasks\n", spec.Name, j.nMap, spec.NReduce)
+	m.wake()
+	return nil
+}
+
+// job returns the job with the given name, or nil
+func (m *Master) job(name string) *job {
+	for _, j := range m.jobs {
+		if j.spec.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// notify wakes up everything waiting for a job to finish
+func (m *Master) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+	m.wake()
+}
+
+// wake wakes up the GetTask requests waiting for a task, after a change
+// that may have made tasks ready
+func (m *Master) wake() {
+	close(m.ready)
+	m.ready = make(chan struct{})
 }
 
 // GetTask assigne task à un worker
 type GetTaskArgs struct {
 	WorkerID string
+	Apps     []string      // Applications the worker has registered
+	Address  string        // Shuffle address of the worker, empty on a shared directory
+	Slots    int           // Tasks the worker runs at once, 1 when zero
+	Wait     time.Duration // How long to wait for a task before replying idle
 }
 
 type GetTaskReply struct {
 	Task Task
 }
 
+// GetTask hands out a task to the worker. Without a task ready, the request
+// is held until one is or until args.Wait expires, so that workers get a
+// task as soon as there is one without polling the master.
 func (m *Master) GetTask(args *GetTaskArgs, reply *GetTaskReply) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	// Register worker if new
-	if _, exists := m.workers[args.WorkerID]; !exists {
-		m.workers[args.WorkerID] = &WorkerInfo{
-			ID:      args.WorkerID,
-			Status:  "idle",
-			Address: args.WorkerID, // Simplified
+	deadline := m.clock.Now().Add(args.Wait)
+	for {
+		if !m.leading() {
+			return ErrNotLeader
 		}
-	}
-
-	// Find a pending or timed-out task
-	now := time.Now()
-	for i, task := range m.tasks {
-		if task.Status == "pending" || (task.Status == "running" && now.Sub(task.StartTime) > 10*time.Second) {
-			m.tasks[i].Status = "running"
-			m.tasks[i].WorkerID = args.WorkerID
-			m.tasks[i].StartTime = now
+		now := m.clock.Now()
+		if task, ok := m.nextTask(args, now); ok || !now.Before(deadline) {
+			if !ok {
+				Debug("Master: No tasks for worker %s, assigned idle\n", args.WorkerID)
+			}
 			reply.Task = task
-			m.workers[args.WorkerID].Status = "working"
-			Debug("Master: Assigned task %d (%s) to worker %s\n", task.ID, task.Type, args.WorkerID)
 			return nil
 		}
+		// Backups of stragglers only depend on time: check again once per
+		// heartbeat interval
+		wait := deadline.Sub(now)
+		if interval := m.config.HeartbeatInterval; interval < wait {
+			wait = interval
+		}
+		ready, done := m.ready, m.done
+		m.mu.Unlock()
+		select {
+		case <-ready:
+		case <-done:
+		case <-m.clock.After(wait):
+		}
+		m.mu.Lock()
 	}
-	// No tasks available
-	reply.Task = Task{Type: IdleTask}
-	m.workers[args.WorkerID].Status = "idle"
-	Debug("Master: No tasks for worker %s, assigned idle\n", args.WorkerID)
+}
+
+// nextTask returns the task to hand out to the worker, or an IdleTask and
+// false when there is none. It must be called with m.mu held.
+func (m *Master) nextTask(args *GetTaskArgs, now time.Time) (Task, bool) {
+	m.touch(args.WorkerID, now)
+	worker := m.workers[args.WorkerID]
+	if args.Address != "" {
+		worker.Address = args.Address
+	}
+	worker.Slots = max(args.Slots, 1)
+	if m.exiting {
+		worker.Status = "exited"
+		Debug("Master: Told worker %s to exit\n", args.WorkerID)
+		return Task{Type: ExitTask}, true
+	}
+
+	// Find a pending task, oldest job first; tasks of crashed workers are
+	// re-queued by the reaper
+	for _, j := range m.jobs {
+		if j.finished() {
+			continue
+		}
+		for i, task := range j.tasks {
+			if !supportsApp(args.Apps, task.App) || !j.ready(task) {
+				continue
+			}
+			if task.Status == "pending" {
+				return m.assign(j, i, args.WorkerID, now, false), true
+			}
+		}
+	}
+	// Otherwise back up a straggler near the end of its phase
+	if j, i, ok := m.straggler(args.WorkerID, args.Apps, now); ok {
+		return m.assign(j, i, args.WorkerID, now, true), true
+	}
+	// No tasks available, or the remaining ones wait on running tasks
+	return Task{Type: IdleTask}, false
+}
+
+// assign starts a new attempt of task i of job j on the worker and returns
+// the task as sent to that worker
+func (m *Master) assign(j *job, i int, workerID string, now time.Time, backup bool) Task {
+	if j.state == JobQueued {
+		if err := m.record(logRecord{Op: "start", Job: j.spec.Name}); err != nil {
+			Debug("Master: %v\n", err)
+		}
+		j.state = JobRunning
+		j.startedAt = now
+		Debug("Master: Job %s started\n", j.spec.Name)
+	}
+	task := &j.tasks[i]
+	attempt := Attempt{
+		ID:        len(task.Attempts) + 1,
+		WorkerID:  workerID,
+		Backup:    backup,
+		Status:    "running",
+		StartTime: now,
+	}
+	attempt.Tag = attemptTag(attempt.ID, now)
+	task.Attempts = append(task.Attempts, attempt)
+	task.Status = "running"
+	if !backup {
+		task.WorkerID = workerID
+		task.StartTime = now
+	}
+	m.workers[workerID].started(TaskRef{JobName: j.spec.Name, TaskID: task.ID, Attempt: attempt.ID, Tag: attempt.Tag})
+	if backup {
+		Debug("Master: Assigned backup attempt %d of task %s/%d (%s) to worker %s\n", attempt.ID, j.spec.Name, task.ID, task.Type, workerID)
+	} else {
+		Debug("Master: Assigned task %s/%d (%s) to worker %s\n", j.spec.Name, task.ID, task.Type, workerID)
+	}
+	assigned := *task
+	assigned.Attempt = attempt.ID
+	assigned.Tag = attempt.Tag
+	if task.Type == ReduceTask {
+		assigned.MapAttempts, assigned.MapLocations = j.mapOutputs()
+	}
+	return assigned
+}
+
+// supportsApp reports whether app is among the applications a worker
+// advertised in its GetTask request
+func supportsApp(apps []string, app string) bool {
+	for _, a := range apps {
+		if a == app {
+			return true
+		}
+	}
+	return false
+}
+
+// touch registers the worker if it is new and records that it is alive.
+// A worker previously marked crashed comes back as idle: its tasks have
+// already been handed to other workers.
+func (m *Master) touch(workerID string, now time.Time) {
+	worker, exists := m.workers[workerID]
+	if !exists {
+		worker = &WorkerInfo{
+			ID:     workerID,
+			Status: "idle",
+		}
+		m.workers[workerID] = worker
+	}
+	if worker.Status == "crashed" {
+		Debug("Master: Worker %s is back\n", workerID)
+		worker.Status = "idle"
+		worker.updateStatus()
+	}
+	worker.LastSeen = now
+}
+
+type HeartbeatArgs struct {
+	WorkerID string
+	Slots    int
+	Running  []TaskRef // Attempts the worker is running
+}
+
+type HeartbeatReply struct{}
+
+// Heartbeat is sent periodically by every worker, including while it
+// executes tasks, so the master can tell slow workers from dead ones. The
+// attempts it lists replace those the master knew of, which a new leader
+// does not, and the attempts it leaves out go to other workers.
+func (m *Master) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.leading() {
+		return ErrNotLeader
+	}
+	now := m.clock.Now()
+	m.touch(args.WorkerID, now)
+	worker := m.workers[args.WorkerID]
+	worker.Slots = max(args.Slots, 1)
+	// An attempt the worker still does not run one heartbeat interval after
+	// it was assigned never reached it: the reply to its long-polled
+	// GetTask was lost with the connection
+	m.loseAttempts(args.WorkerID, now, func(ref TaskRef, attempt Attempt) bool {
+		for _, running := range args.Running {
+			if running == ref {
+				return false
+			}
+		}
+		return now.Sub(attempt.StartTime) > m.config.HeartbeatInterval
+	})
+	worker.Running = append([]TaskRef(nil), args.Running...)
+	worker.updateStatus()
 	return nil
 }
 
+// reap marks the workers that missed too many heartbeats as crashed and
+// puts their running tasks back in the pending state, as well as the
+// completed tasks whose output they served
+func (m *Master) reap(now time.Time) {
+	timeout := time.Duration(m.config.MissedHeartbeats) * m.config.HeartbeatInterval
+	for _, worker := range m.workers {
+		if worker.Status == "crashed" || worker.Status == "exited" || now.Sub(worker.LastSeen) <= timeout {
+			continue
+		}
+		worker.Status = "crashed"
+		worker.Running = nil
+		Debug("Master: Worker %s crashed, last seen %v ago\n", worker.ID, now.Sub(worker.LastSeen))
+		m.loseAttempts(worker.ID, now, func(TaskRef, Attempt) bool { return true })
+		m.loseOutputs(worker)
+	}
+}
+
+// loseAttempts marks the running attempts of the worker selected by lost
+// as lost, and puts their tasks back in the pending state unless another
+// attempt runs. It must be called with m.mu held.
+func (m *Master) loseAttempts(workerID string, now time.Time, lost func(TaskRef, Attempt) bool) {
+	for _, j := range m.jobs {
+		for i := range j.tasks {
+			task := &j.tasks[i]
+			if task.Status != "running" {
+				continue
+			}
+			running, released := 0, false
+			for k := range task.Attempts {
+				attempt := &task.Attempts[k]
+				if attempt.Status != "running" {
+					continue
+				}
+				if attempt.WorkerID == workerID && lost(TaskRef{JobName: j.spec.Name, TaskID: task.ID, Attempt: attempt.ID, Tag: attempt.Tag}, *attempt) {
+					attempt.Status = "lost"
+					attempt.EndTime = now
+					released = true
+				} else {
+					running++
+				}
+			}
+			if released && running == 0 {
+				task.Status = "pending"
+				task.WorkerID = ""
+				Debug("Master: Re-queued task %s/%d of worker %s\n", j.spec.Name, task.ID, workerID)
+				m.wake()
+			}
+		}
+	}
+}
+
+// startReaper checks worker liveness once per heartbeat interval
+func (m *Master) startReaper() {
+	go func() {
+		for {
+			select {
+			case now := <-m.clock.After(m.config.HeartbeatInterval):
+				m.mu.Lock()
+				m.reap(now)
+				m.mu.Unlock()
+			case <-m.done:
+				return
+			}
+		}
+	}()
+}
+
 // ReportTaskDone marks a task as completed
 type ReportTaskDoneArgs struct {
+	JobName  string
 	TaskID   int
+	Attempt  int
+	Tag      string // Tag of the attempt, see TaskRef
 	WorkerID string
+	Counters Counters
+	Address  string // Shuffle address serving the output files, empty on a shared directory
 }
 
 type ReportTaskDoneReply struct{}
 
 // ReportTaskDone updates the status of a task to completed
-// and notifies the master if all tasks are done
+// and notifies the master if all tasks are done. Only the first attempt of a
+// task to report counts: logging it commits its output files, and the other
+// attempts are marked superseded. Attempts are known by their tag, so that
+// the report of an attempt started by a previous master is ignored.
 func (m *Master) ReportTaskDone(args *ReportTaskDoneArgs, reply *ReportTaskDoneReply) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if !m.leading() {
+		return ErrNotLeader
+	}
+
+	now := m.clock.Now()
+	if worker, ok := m.workers[args.WorkerID]; ok {
+		worker.stopped(TaskRef{JobName: args.JobName, TaskID: args.TaskID, Attempt: args.Attempt, Tag: args.Tag})
+	}
+	j := m.job(args.JobName)
+	if j != nil && j.finished() {
+		m.cleanLate(j, args.WorkerID)
+		return nil
+	}
+	if j == nil || args.TaskID < 0 || args.TaskID >= len(j.tasks) {
+		return nil
+	}
+	task := &j.tasks[args.TaskID]
+	if task.Status != "running" {
+		Debug("Master: Ignored report of attempt %d of task %d by worker %s, task is %s\n", args.Attempt, task.ID, args.WorkerID, task.Status)
+		return nil
+	}
+	var won *Attempt
+	for j := range task.Attempts {
+		attempt := &task.Attempts[j]
+		if attempt.ID == args.Attempt && attempt.Tag == args.Tag && attempt.WorkerID == args.WorkerID && attempt.Status == "running" {
+			won = attempt
+		}
+	}
+	if won == nil {
+		Debug("Master: Ignored report of stale attempt %d of task %d by worker %s\n", args.Attempt, task.ID, args.WorkerID)
+		return nil
+	}
+	counters := args.Counters
+	if err := m.record(logRecord{Op: "complete", Job: j.spec.Name, TaskID: task.ID, WorkerID: args.WorkerID, Counters: &counters, Tag: won.Tag, Address: args.Address}); err != nil {
+		return err
+	}
+	for j := range task.Attempts {
+		attempt := &task.Attempts[j]
+		if attempt == won {
+			attempt.Status = "completed"
+			attempt.EndTime = now
+		} else if attempt.Status == "running" {
+			attempt.Status = "superseded"
+			attempt.EndTime = now
+		}
+	}
+
+	phase := j.phase()
+	task.Status = "completed"
+	task.WorkerID = args.WorkerID
+	task.Counters = args.Counters
+	task.Committed = won.Tag
+	task.Location = args.Address
+	j.tasksDone++
+	Debug("Master: Task %s/%d completed by worker %s (attempt %d), %d/%d done\n", j.spec.Name, task.ID, args.WorkerID, args.Attempt, j.tasksDone, len(j.tasks))
+	if next := j.phase(); next != phase {
+		Debug("Master: Job %s entering %s phase\n", j.spec.Name, next)
+	}
+	if j.phase() == DonePhase {
+		go m.finish(j)
+	}
+	m.wake()
+	return nil
+}
+
+// ReportTaskFailedArgs reports an attempt that could not run its task
+type ReportTaskFailedArgs struct {
+	JobName  string
+	TaskID   int
+	Attempt  int
+	Tag      string // Tag of the attempt, see TaskRef
+	WorkerID string
+	Error    string
+	Kind     string // Kind of the error, such as ErrMissingInput, by its text
+	LostMaps []int  // Map tasks whose output a reduce task could not read
+}
+
+type ReportTaskFailedReply struct{}
+
+// ReportTaskFailed records why an attempt failed and hands the task out
+// again, unless another attempt is still running. The job fails once the
+// task has failed MaxAttempts times. A reduce task that could not read the
+// output of map tasks is not at fault: those map tasks run again first.
+func (m *Master) ReportTaskFailed(args *ReportTaskFailedArgs, reply *ReportTaskFailedReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.leading() {
+		return ErrNotLeader
+	}
 
-	for i, task := range m.tasks {
-		if task.ID == args.TaskID && task.Status == "running" && task.WorkerID == args.WorkerID {
-			m.tasks[i].Status = "completed"
-			m.tasksDone++
-			m.workers[args.WorkerID].Status = "idle"
-			Debug("Master: Task %d completed by worker %s, %d/%d done\n", task.ID, args.WorkerID, m.tasksDone, m.totalTasks)
-			if m.tasksDone == m.totalTasks {
-				m.done <- true
+	now := m.clock.Now()
+	if worker, ok := m.workers[args.WorkerID]; ok {
+		worker.stopped(TaskRef{JobName: args.JobName, TaskID: args.TaskID, Attempt: args.Attempt, Tag: args.Tag})
+	}
+	j := m.job(args.JobName)
+	if j != nil && j.finished() {
+		m.cleanLate(j, args.WorkerID)
+		return nil
+	}
+	if j == nil || args.TaskID < 0 || args.TaskID >= len(j.tasks) {
+		return nil
+	}
+	task := &j.tasks[args.TaskID]
+	if task.Status != "running" {
+		return nil
+	}
+	var failed *Attempt
+	running := 0
+	for k := range task.Attempts {
+		attempt := &task.Attempts[k]
+		if attempt.ID == args.Attempt && attempt.Tag == args.Tag && attempt.WorkerID == args.WorkerID && attempt.Status == "running" {
+			failed = attempt
+		} else if attempt.Status == "running" {
+			running++
+		}
+	}
+	if failed == nil {
+		Debug("Master: Ignored failure of stale attempt %d of task %d by worker %s\n", args.Attempt, task.ID, args.WorkerID)
+		return nil
+	}
+	failed.Status = "failed"
+	failed.Error = args.Error
+	failed.EndTime = now
+	Debug("Master: Attempt %d of task %s/%d failed on worker %s: %s\n", args.Attempt, j.spec.Name, task.ID, args.WorkerID, args.Error)
+
+	counted := true
+	if task.Type == ReduceTask && len(args.LostMaps) > 0 {
+		// The map tasks run again first, and the failure does not count.
+		// Losing again the output of a map task that already ran again for
+		// this reduce task counts, or the reduce task could be retried
+		// without end.
+		counted = false
+		for _, id := range args.LostMaps {
+			if id < 0 || id >= j.nMap {
+				continue
+			}
+			if slices.Contains(task.Recomputed, id) {
+				counted = true
+			} else {
+				task.Recomputed = append(task.Recomputed, id)
+			}
+			if err := m.lose(j, id); err != nil {
+				return err
+			}
+		}
+	}
+	if counted {
+		task.Failures++
+		if m.config.MaxAttempts > 0 && task.Failures >= m.config.MaxAttempts {
+			reason := fmt.Sprintf("%s task %d failed %d times, last error: %s", task.Type, task.ID, task.Failures, args.Error)
+			return m.abort(j, JobFailed, reason, args.Kind)
+		}
+	}
+	if running == 0 {
+		task.Status = "pending"
+		task.WorkerID = ""
+		m.wake()
+	}
+	return nil
+}
+
+// lose makes completed task i of job j pending again because its output
+// is lost, so that it runs again. It must be called with m.mu held.
+func (m *Master) lose(j *job, i int) error {
+	task := &j.tasks[i]
+	if task.Status != "completed" {
+		return nil
+	}
+	if err := m.record(logRecord{Op: "lost", Job: j.spec.Name, TaskID: task.ID}); err != nil {
+		return err
+	}
+	phase := j.phase()
+	j.reset(i)
+	m.wake()
+	Debug("Master: Output of task %s/%d lost, re-queued\n", j.spec.Name, task.ID)
+	if next := j.phase(); next != phase {
+		Debug("Master: Job %s back to %s phase\n", j.spec.Name, next)
+	}
+	return nil
+}
+
+// loseOutputs re-queues the completed tasks of the unfinished jobs whose
+// output was served by a crashed worker: its reduce outputs, and its map
+// outputs while reduce tasks still need them. It must be called with m.mu
+// held.
+func (m *Master) loseOutputs(worker *WorkerInfo) {
+	if worker.Address == "" {
+		return
+	}
+	for _, j := range m.jobs {
+		if j.finished() {
+			continue
+		}
+		for _, taskType := range []TaskType{ReduceTask, MapTask} {
+			if taskType == MapTask && j.phase() == DonePhase {
+				break
+			}
+			for i := range j.tasks {
+				task := &j.tasks[i]
+				if task.Type != taskType || task.Status != "completed" || task.Location != worker.Address {
+					continue
+				}
+				if err := m.lose(j, i); err != nil {
+					Debug("Master: %v\n", err)
+				}
+			}
+		}
+	}
+}
+
+// abort ends a job that did not complete and removes its intermediate
+// files. It must be called with m.mu held.
+func (m *Master) abort(j *job, state JobState, reason, kind string) error {
+	op := "finish"
+	if state == JobCancelled {
+		op = "cancel"
+	}
+	if err := m.record(logRecord{Op: op, Job: j.spec.Name, State: state, Error: reason, Kind: kind}); err != nil {
+		return err
+	}
+	j.state = state
+	j.err = reason
+	j.errKind = kind
+	j.finishedAt = m.clock.Now()
+	m.clean(j)
+	if reason != "" {
+		Debug("Master: Job %s %s: %s\n", j.spec.Name, state, reason)
+	} else {
+		Debug("Master: Job %s %s\n", j.spec.Name, state)
+	}
+	m.notify()
+	return nil
+}
+
+// clean removes the intermediate files of a job, from the shared directory
+// and from the workers that ran its tasks. It must be called with m.mu held.
+func (m *Master) clean(j *job) {
+	CleanIntermediary(j.spec.Name, j.nMap, j.spec.NReduce)
+	seen := make(map[string]bool)
+	var addrs []string
+	add := func(addr string) {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, task := range j.tasks {
+		add(task.Location)
+		for _, attempt := range task.Attempts {
+			if worker, ok := m.workers[attempt.WorkerID]; ok {
+				add(worker.Address)
 			}
-			break
 		}
 	}
+	if len(addrs) > 0 {
+		go cleanRemote(addrs, j.spec.Name, j.nMap, j.spec.NReduce)
+	}
+}
+
+// cleanLate removes the files of an attempt reported after its job
+// finished: the attempt kept running on its worker once the job was
+// cancelled or failed, and wrote its files after the job was cleaned. It
+// must be called with m.mu held.
+func (m *Master) cleanLate(j *job, workerID string) {
+	Debug("Master: Late report of job %s by worker %s, cleaning again\n", j.spec.Name, workerID)
+	m.clean(j)
+}
+
+// finish merges the output of a job whose tasks are all completed and
+// removes its intermediate files
+func (m *Master) finish(j *job) {
+	m.mu.Lock()
+	name, nMap, nReduce := j.spec.Name, j.nMap, j.spec.NReduce
+	outputs := append([]Task(nil), j.tasks[nMap:]...)
+	m.mu.Unlock()
+
+	// The output of each reduce task is on its worker, or in the shared
+	// directory
+	err := mergeOutput("", name, nReduce, func(reduceTask int) (io.ReadCloser, error) {
+		task := outputs[reduceTask]
+		return openShuffle(task.Location, "", AttemptName(MergeName(name, reduceTask), task.Committed), DefaultFetchTimeout)
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if j.state == JobCancelled {
+		return
+	}
+	j.finishedAt = m.clock.Now()
+	if err != nil {
+		j.state = JobFailed
+		j.err = err.Error()
+		j.errKind = errorKind(err)
+		Debug("Master: Job %s failed: %s\n", name, j.err)
+	} else {
+		j.state = JobDone
+		Debug("Master: Job %s completed\n", name)
+	}
+	// The intermediate files are only removed once the end of the job is
+	// logged, a recovered master merges them again otherwise. A failed job
+	// is not merged again, its files go as well.
+	if logErr := m.record(logRecord{Op: "finish", Job: name, State: j.state, Error: j.err, Kind: j.errKind}); logErr != nil {
+		Debug("Master: %v\n", logErr)
+	} else {
+		m.clean(j)
+	}
+	m.notify()
+}
+
+type SubmitJobArgs struct {
+	Spec JobSpec
+}
+
+type SubmitJobReply struct {
+	Job JobStatus
+}
+
+// SubmitJob queues a new job, see Submit
+func (m *Master) SubmitJob(args *SubmitJobArgs, reply *SubmitJobReply) error {
+	if err := m.Submit(args.Spec); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	reply.Job = m.job(args.Spec.Name).status()
+	return nil
+}
+
+type CancelJobArgs struct {
+	Name string
+}
+
+type CancelJobReply struct {
+	Job JobStatus
+}
+
+// CancelJob stops handing out the tasks of a queued or running job and
+// removes its intermediate files. Attempts still running on workers are
+// not stopped: their files are removed when they report.
+func (m *Master) CancelJob(args *CancelJobArgs, reply *CancelJobReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.leading() {
+		return ErrNotLeader
+	}
+	j := m.job(args.Name)
+	if j == nil {
+		return fmt.Errorf("unknown job %q", args.Name)
+	}
+	if j.finished() {
+		return fmt.Errorf("job %q is already %s", args.Name, j.state)
+	}
+	if j.phase() == DonePhase {
+		return fmt.Errorf("job %q is already merging its output", args.Name)
+	}
+	if err := m.abort(j, JobCancelled, "", ""); err != nil {
+		return err
+	}
+	reply.Job = j.status()
 	return nil
 }
 
-// CheckError checks for errors and panics if any
-func (m *Master) startRPC() {
-	rpc.Register(m)
-	rpc.HandleHTTP()
-	listener, err := net.Listen("tcp", ":1234")
-	CheckError(err, "cannot start RPC server: %v\n", err)
-	go http.Serve(listener, nil)
+type ListJobsArgs struct{}
+
+type ListJobsReply struct {
+	Jobs []JobStatus
+}
+
+// ListJobs returns the status of every job, in submission order
+func (m *Master) ListJobs(args *ListJobsArgs, reply *ListJobsReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		reply.Jobs = append(reply.Jobs, j.status())
+	}
+	return nil
+}
+
+type GetJobArgs struct {
+	Name string
+}
+
+type GetJobReply struct {
+	Job   JobStatus
+	Tasks []Task
+}
+
+// GetJob returns the status and the tasks of a job
+func (m *Master) GetJob(args *GetJobArgs, reply *GetJobReply) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.job(args.Name)
+	if j == nil {
+		return fmt.Errorf("unknown job %q", args.Name)
+	}
+	reply.Job = j.status()
+	reply.Tasks = append(reply.Tasks, j.tasks...)
+	return nil
+}
+
+// startRPC starts the RPC server. It has its own rpc.Server and ServeMux so
+// that several masters can run in one process.
+func (m *Master) startRPC() error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Master", m); err != nil {
+		return err
+	}
+	handler := newRPCHandler(server)
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, handler)
+	listener, err := net.Listen("tcp", m.rpcAddr())
+	if err != nil {
+		return fmt.Errorf("cannot start RPC server: %w", err)
+	}
+	m.mu.Lock()
+	m.rpcListener = listener
+	m.rpcHandler = handler
+	m.rpcServer = &http.Server{Handler: mux}
+	m.mu.Unlock()
+	Debug("Master: RPC server listening on %s\n", listener.Addr())
+	go m.rpcServer.Serve(listener)
+	return nil
 }
 
 // startHTTP starts the HTTP server for monitoring
-func (m *Master) startHTTP() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+func (m *Master) startHTTP() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
 		http.ServeFile(w, r, filepath.Join("web", "index.html"))
 	})
-	http.HandleFunc("/data", m.serveData)
-	go http.ListenAndServe(":8080", nil)
+	mux.HandleFunc("/data", m.serveData)
+	addr := m.config.HTTPAddr
+	if addr == "" {
+		addr = ":8080"
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot start HTTP server: %w", err)
+	}
+	m.mu.Lock()
+	m.httpListener = listener
+	m.httpServer = &http.Server{Handler: mux}
+	m.mu.Unlock()
+	Debug("Master: Dashboard listening on %s\n", listener.Addr())
+	go m.httpServer.Serve(listener)
+	return nil
+}
+
+// RPCAddr returns the address the RPC server listens on, empty until the
+// master is started
+func (m *Master) RPCAddr() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.rpcListener == nil {
+		return ""
+	}
+	return m.rpcListener.Addr().String()
+}
+
+// HTTPAddr returns the address of the dashboard, empty until the master is
+// started
+func (m *Master) HTTPAddr() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.httpListener == nil {
+		return ""
+	}
+	return m.httpListener.Addr().String()
 }
 
 // serveData serves the current state of the master
-// including tasks, workers, and task completion status
+// including jobs with their tasks, and workers
 func (m *Master) serveData(w http.ResponseWriter, r *http.Request) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	type JobData struct {
+		JobStatus
+		Tasks []Task `json:"tasks"`
+	}
 	type Data struct {
-		Tasks      []Task       `json:"tasks"`
-		Workers    []WorkerInfo `json:"workers"`
-		TasksDone  int          `json:"tasksDone"`
-		TotalTasks int          `json:"totalTasks"`
+		Jobs    []JobData    `json:"jobs"`
+		Workers []WorkerInfo `json:"workers"`
 	}
 
 	data := Data{
-		Tasks:      m.tasks,
-		Workers:    make([]WorkerInfo, 0, len(m.workers)),
-		TasksDone:  m.tasksDone,
-		TotalTasks: m.totalTasks,
+		Jobs:    make([]JobData, 0, len(m.jobs)),
+		Workers: make([]WorkerInfo, 0, len(m.workers)),
+	}
+	for _, j := range m.jobs {
+		data.Jobs = append(data.Jobs, JobData{JobStatus: j.status(), Tasks: j.tasks})
 	}
 	for _, worker := range m.workers {
 		data.Workers = append(data.Workers, *worker)
@@ -213,20 +1128,113 @@ func (m *Master) serveData(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(data)
 }
 
-// Run starts the master
-func (m *Master) Run() {
+// Start starts the RPC and HTTP servers and the reaper, and returns once
+// the servers listen. Run and Serve call it.
+func (m *Master) Start() error {
 	Debug("Master: Starting RPC and HTTP servers\n")
-	m.startRPC()
-	m.startHTTP()
+	if err := m.startRPC(); err != nil {
+		return err
+	}
+	if err := m.startHTTP(); err != nil {
+		return err
+	}
+	m.startReaper()
+	if m.lease != nil {
+		// The standby masters dial the address the RPC server is bound to
+		m.lease.addr = advertisedAddr(m.rpcListener)
+		go m.elect()
+	}
+	return nil
+}
+
+// rpcAddr returns the address of the RPC server
+func (m *Master) rpcAddr() string {
+	if m.config.RPCAddr == "" {
+		return ":1234"
+	}
+	return m.config.RPCAddr
+}
+
+// Run starts the master and returns once every submitted job has finished.
+// The error is a *JobError for the first job that failed or was cancelled.
+func (m *Master) Run() error {
+	if err := m.Start(); err != nil {
+		return err
+	}
+	for {
+		m.mu.Lock()
+		finished := true
+		for _, j := range m.jobs {
+			finished = finished && j.finished()
+		}
+		changed := m.changed
+		m.mu.Unlock()
+		if finished {
+			break
+		}
+		<-changed
+	}
+	m.mu.Lock()
+	m.exiting = true
+	m.wake()
+	m.mu.Unlock()
+	Debug("Master: Jobs finished, keeping the servers up for %v\n", m.config.Linger)
+	select {
+	case <-m.clock.After(m.config.Linger):
+	case <-m.done:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		Debug("Master: %v\n", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, j := range m.jobs {
+		if err := j.status().Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown tells the workers to exit, stops the servers once their
+// requests are done or ctx expires, and stops the reaper and the election.
+// Tasks still running are lost.
+func (m *Master) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	m.exiting = true
+	select {
+	case <-m.done:
+	default:
+		close(m.done)
+	}
+	rpcServer, handler, httpServer := m.rpcServer, m.rpcHandler, m.httpServer
+	m.mu.Unlock()
+
+	Debug("Master: Shutting down\n")
+	var err error
+	for _, server := range []*http.Server{rpcServer, httpServer} {
+		if server == nil {
+			continue
+		}
+		if shutdownErr := server.Shutdown(ctx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	if handler != nil {
+		handler.close()
+	}
+	return err
+}
+
+// Serve starts the master and keeps running jobs as they are submitted,
+// until Shutdown is called or the master cannot start
+func (m *Master) Serve() error {
+	if err := m.Start(); err != nil {
+		return err
+	}
 	<-m.done
-	resFiles := make([]string, 0, m.nReduce)
-	for i := 0; i < m.nReduce; i++ {
-		resFiles = append(resFiles, MergeName(m.jobName, i))
-	}
-	err := concatFiles(AnsName(m.jobName), resFiles)
-	CheckError(err, "cannot merge output files: %v\n")
-	CleanIntermediary(m.jobName, len(m.files), m.nReduce)
-	Debug("Master: Job %s completed\n", m.jobName)
-	Debug("Master: Keeping HTTP server alive for 30 seconds\n")
-	time.Sleep(30 * time.Second)
+	return nil
 }
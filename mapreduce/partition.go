@@ -0,0 +1,135 @@
+package mapreduce
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Partitioner chooses the reduce task, in [0, nReduce), that receives the
+// pairs with a given key. Every map task of a job must use the same one.
+type Partitioner interface {
+	Partition(key string, nReduce int) int
+}
+
+// PartitionerFunc adapts an ordinary function to the Partitioner interface
+type PartitionerFunc func(key string, nReduce int) int
+
+func (f PartitionerFunc) Partition(key string, nReduce int) int {
+	return f(key, nReduce)
+}
+
+// HashPartitioner spreads keys with an FNV hash. It is the default.
+type HashPartitioner struct{}
+
+func (HashPartitioner) Partition(key string, nReduce int) int {
+	return int(ihash(key)) % nReduce
+}
+
+// RangePartitioner sends keys lower than Boundaries[0] to reduce task 0, keys
+// in [Boundaries[0], Boundaries[1]) to reduce task 1, and so on. Boundaries
+// must be sorted. Since reduce tasks sort their keys, concatenating the
+// outputs in order gives a globally sorted result.
+type RangePartitioner struct {
+	Boundaries []string
+}
+
+func (p RangePartitioner) Partition(key string, nReduce int) int {
+	r := sort.Search(len(p.Boundaries), func(i int) bool { return p.Boundaries[i] > key })
+	if r >= nReduce {
+		r = nReduce - 1
+	}
+	return r
+}
+
+// PrefixPartitioner hashes only the first Length bytes of a key, so that
+// keys sharing a prefix end up in the same output file
+type PrefixPartitioner struct {
+	Length int
+}
+
+func (p PrefixPartitioner) Partition(key string, nReduce int) int {
+	if len(key) > p.Length {
+		key = key[:p.Length]
+	}
+	return HashPartitioner{}.Partition(key, nReduce)
+}
+
+var (
+	partitionersMu sync.RWMutex
+	partitioners   = make(map[string]Partitioner)
+)
+
+// RegisterPartitioner makes a custom partitioner available to
+// ParsePartitioner under name. Like RegisterApp, it panics on an empty,
+// reserved or duplicate name.
+func RegisterPartitioner(name string, p Partitioner) {
+	partitionersMu.Lock()
+	defer partitionersMu.Unlock()
+
+	switch name {
+	case "", "hash", "range", "prefix":
+		panic(fmt.Sprintf("mapreduce: cannot register partitioner %q", name))
+	}
+	if _, exists := partitioners[name]; exists {
+		panic(fmt.Sprintf("mapreduce: partitioner %q registered twice", name))
+	}
+	partitioners[name] = p
+}
+
+// ParsePartitioner builds the partitioner described by spec, the form in
+// which tasks carry it:
+//
+//	"" or "hash"      HashPartitioner
+//	"range:g,p"       RangePartitioner{Boundaries: []string{"g", "p"}}
+//	"prefix:2"        PrefixPartitioner{Length: 2}
+//	"<name>"          a partitioner registered with RegisterPartitioner
+func ParsePartitioner(spec string) (Partitioner, error) {
+	if p, builtin, err := parseBuiltin(spec); builtin {
+		return p, err
+	}
+
+	partitionersMu.RLock()
+	defer partitionersMu.RUnlock()
+	p, ok := partitioners[spec]
+	if !ok {
+		return nil, fmt.Errorf("unknown partitioner %q", spec)
+	}
+	return p, nil
+}
+
+// checkPartitioner checks a partitioner spec the way a master can: custom
+// partitioners are registered on the workers only, which fail the tasks of
+// a name they do not know, so only the built-in ones are checked
+func checkPartitioner(spec string) error {
+	_, _, err := parseBuiltin(spec)
+	return err
+}
+
+// parseBuiltin builds the built-in partitioner described by spec, and
+// reports whether spec describes one
+func parseBuiltin(spec string) (Partitioner, bool, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "hash":
+		return HashPartitioner{}, true, nil
+	case "range":
+		var boundaries []string
+		if arg != "" {
+			boundaries = strings.Split(arg, ",")
+		}
+		if !sort.StringsAreSorted(boundaries) {
+			return nil, true, fmt.Errorf("range partitioner boundaries %q are not sorted", arg)
+		}
+		return RangePartitioner{Boundaries: boundaries}, true, nil
+	case "prefix":
+		length, err := strconv.Atoi(arg)
+		if err != nil || length < 0 {
+			return nil, true, fmt.Errorf("invalid prefix partitioner length %q", arg)
+		}
+		return PrefixPartitioner{Length: length}, true, nil
+	}
+	return nil, false, nil
+}
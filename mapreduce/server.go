@@ -0,0 +1,63 @@
+package mapreduce
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+)
+
+// rpcHandler serves RPCs over HTTP CONNECT requests like rpc.Server does,
+// and keeps track of the connections it hijacks so that they are closed
+// with the server: http.Server.Shutdown ignores hijacked connections.
+type rpcHandler struct {
+	server *rpc.Server
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+func newRPCHandler(server *rpc.Server) *rpcHandler {
+	return &rpcHandler{server: server, conns: make(map[net.Conn]bool)}
+}
+
+func (h *rpcHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "CONNECT" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "405 must CONNECT\n")
+		return
+	}
+	conn, _, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		Debug("Master: Cannot hijack RPC connection from %s: %v\n", req.RemoteAddr, err)
+		return
+	}
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		conn.Close()
+		return
+	}
+	h.conns[conn] = true
+	h.mu.Unlock()
+
+	// The status rpc.DialHTTP expects
+	io.WriteString(conn, "HTTP/1.0 200 Connected to Go RPC\n\n")
+	h.server.ServeConn(conn)
+
+	h.mu.Lock()
+	delete(h.conns, conn)
+	h.mu.Unlock()
+}
+
+// close closes the RPC connections and refuses new ones
+func (h *rpcHandler) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for conn := range h.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,141 @@
+package mapreduce
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Workers that do not share a directory with the master and the other
+// workers run a shuffle server: map tasks keep their intermediate files in
+// the worker's directory, reduce tasks fetch their partition from the worker
+// of each map task, and the master fetches the output of the reduce tasks.
+// A worker reports the address of its shuffle server with the tasks it
+// completes; without one, the files are read from the shared directory.
+
+// ShuffleHandler serves the intermediate and output files of the tasks run
+// in dir:
+//
+//	GET  /shuffle/<name>                     the file <name>, see AttemptName
+//	POST /clean?job=<job>&maps=<n>&reduces=<n>  removes the files of a job
+//
+// Neither route is authenticated: both only reach the files of tasks in
+// dir, and the server should only listen on the network of the cluster.
+func ShuffleHandler(dir string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/shuffle/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/shuffle/")
+		// Only serve the files of tasks, nothing else of the directory
+		if !strings.HasPrefix(name, prefix) || strings.ContainsAny(name, `/\`) {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(dir, name))
+	})
+	mux.HandleFunc("/clean", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "POST only", http.StatusMethodNotAllowed)
+			return
+		}
+		job := r.FormValue("job")
+		nMap, err1 := strconv.Atoi(r.FormValue("maps"))
+		nReduce, err2 := strconv.Atoi(r.FormValue("reduces"))
+		if err1 != nil || err2 != nil {
+			http.Error(w, "bad clean request", http.StatusBadRequest)
+			return
+		}
+		// The job name is part of the paths of the removed files
+		if err := checkJobName(job); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cleanIntermediary(dir, job, nMap, nReduce)
+	})
+	return mux
+}
+
+// DefaultFetchTimeout is how long fetching a file from a shuffle server
+// may take when no other timeout is set
+const DefaultFetchTimeout = 30 * time.Second
+
+// ShuffleFetcher returns an Options.OpenIntermediate function for a reduce
+// task: the intermediate file of map task i is fetched from the shuffle
+// server at locations[i], or read from dir when the map task reported no
+// address. A fetch still going on after timeout fails, and the output of
+// the map task is taken for lost; DefaultFetchTimeout applies when timeout
+// is zero.
+func ShuffleFetcher(locations []string, dir string, timeout time.Duration) func(mapTask int, name string) (io.ReadCloser, error) {
+	return func(mapTask int, name string) (io.ReadCloser, error) {
+		var addr string
+		if mapTask < len(locations) {
+			addr = locations[mapTask]
+		}
+		return openShuffle(addr, dir, name, timeout)
+	}
+}
+
+// openShuffle opens the file <name> on the shuffle server at addr, or in
+// dir when addr is empty. A file the server does not have is reported like
+// a missing local file. The timeout covers reading the file as well.
+func openShuffle(addr, dir, name string, timeout time.Duration) (io.ReadCloser, error) {
+	if addr == "" {
+		return os.Open(filepath.Join(dir, name))
+	}
+	if timeout <= 0 {
+		timeout = DefaultFetchTimeout
+	}
+	path := "http://" + addr + "/shuffle/" + url.PathEscape(name)
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &os.PathError{Op: "fetch", Path: path, Err: os.ErrNotExist}
+		}
+		return nil, fmt.Errorf("fetch %s: %s", path, resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// cleanRemote asks the shuffle servers at addrs to remove the files of a
+// job
+func cleanRemote(addrs []string, jobName string, nMap, nReduce int) {
+	form := url.Values{
+		"job":     {jobName},
+		"maps":    {strconv.Itoa(nMap)},
+		"reduces": {strconv.Itoa(nReduce)},
+	}
+	client := &http.Client{Timeout: DefaultFetchTimeout}
+	for _, addr := range addrs {
+		resp, err := client.PostForm("http://"+addr+"/clean", form)
+		if err != nil {
+			Debug("Master: Cannot clean job %s on %s: %v\n", jobName, addr, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// advertisedAddr returns the address other machines reach a listener at:
+// a listener on all interfaces is reached through the host name
+func advertisedAddr(listener net.Listener) string {
+	addr := listener.Addr().(*net.TCPAddr)
+	if !addr.IP.IsUnspecified() {
+		return addr.String()
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(addr.Port))
+}
@@ -0,0 +1,85 @@
+package mapreduce
+
+import (
+	"sort"
+	"time"
+)
+
+// medianDuration returns the median duration of the winning attempts of the
+// completed tasks of the given type, and false if none has completed yet
+func (j *job) medianDuration(taskType TaskType) (time.Duration, bool) {
+	var durations []time.Duration
+	for _, task := range j.tasks {
+		if task.Type != taskType || task.Status != "completed" {
+			continue
+		}
+		for _, attempt := range task.Attempts {
+			if attempt.Status == "completed" {
+				durations = append(durations, attempt.EndTime.Sub(attempt.StartTime))
+			}
+		}
+	}
+	if len(durations) == 0 {
+		return 0, false
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2], true
+}
+
+// straggler picks a running task that deserves a backup attempt on the
+// given worker, among the unfinished jobs in submission order
+func (m *Master) straggler(workerID string, apps []string, now time.Time) (*job, int, bool) {
+	if m.config.SpeculationFactor <= 0 {
+		return nil, 0, false
+	}
+	for _, j := range m.jobs {
+		if j.finished() {
+			continue
+		}
+		if i, ok := j.straggler(workerID, apps, m.config.SpeculationFactor, now); ok {
+			return j, i, true
+		}
+	}
+	return nil, 0, false
+}
+
+// straggler picks a running task of the job that deserves a backup attempt
+// on the given worker. Backups are only launched near the end of a phase,
+// when no task of the phase is pending anymore, for tasks with a single
+// running attempt that has been running factor times longer than the median
+// of the phase.
+func (j *job) straggler(workerID string, apps []string, factor float64, now time.Time) (int, bool) {
+	taskType := MapTask
+	if j.phase() == ReducePhase {
+		taskType = ReduceTask
+	}
+	for _, task := range j.tasks {
+		if task.Type == taskType && task.Status == "pending" {
+			return 0, false
+		}
+	}
+	median, ok := j.medianDuration(taskType)
+	if !ok {
+		return 0, false
+	}
+	threshold := time.Duration(factor * float64(median))
+
+	for i, task := range j.tasks {
+		if task.Type != taskType || task.Status != "running" || !supportsApp(apps, task.App) {
+			continue
+		}
+		var running []Attempt
+		for _, attempt := range task.Attempts {
+			if attempt.Status == "running" {
+				running = append(running, attempt)
+			}
+		}
+		if len(running) != 1 || running[0].WorkerID == workerID {
+			continue
+		}
+		if now.Sub(running[0].StartTime) > threshold {
+			return i, true
+		}
+	}
+	return 0, false
+}
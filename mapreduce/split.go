@@ -0,0 +1,171 @@
+package mapreduce
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+// Split is the part of an input file processed by one map task: the lines
+// that start in [Offset, Offset+Length). A line crossing the end of a split
+// belongs entirely to that split, and the next split skips it. A zero Length
+// means up to the end of the file.
+type Split struct {
+	File   string
+	Offset int64
+	Length int64
+}
+
+// SplitFile cuts file in byte ranges of splitSize bytes. It does not need to
+// look for line boundaries: readers of a split apply the rule above, so every
+// line is read by exactly one split. A splitSize of zero or less, or an empty
+// file, gives a single split covering the whole file.
+func SplitFile(file string, splitSize int64) ([]Split, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if splitSize <= 0 || size <= splitSize {
+		return []Split{{File: file}}, nil
+	}
+	var splits []Split
+	for offset := int64(0); offset < size; offset += splitSize {
+		length := splitSize
+		if offset+length > size {
+			length = size - offset
+		}
+		splits = append(splits, Split{File: file, Offset: offset, Length: length})
+	}
+	return splits, nil
+}
+
+// RecordReader yields the records of a split one at a time, so that map
+// tasks never hold more than a record of their input in memory. Next returns
+// io.EOF once the split is exhausted.
+type RecordReader interface {
+	Next() (string, error)
+	Close() error
+}
+
+// ReaderFunc opens a RecordReader over a split. Readers of formats other
+// than lines must follow the same boundary rule as NewLineReader: a record
+// belongs to the split in which it starts.
+type ReaderFunc func(split Split) (RecordReader, error)
+
+// lineReader reads the lines of a split, without their newline
+type lineReader struct {
+	file   *os.File
+	reader *bufio.Reader
+	pos    int64 // Offset of the next line in the file
+	end    int64 // Lines starting at or after end belong to the next split, -1 for none
+}
+
+// NewLineReader is the default ReaderFunc, returning each line of the split
+// as a record
+func NewLineReader(split Split) (RecordReader, error) {
+	file, err := os.Open(split.File)
+	if err != nil {
+		return nil, err
+	}
+	r := &lineReader{file: file, end: -1}
+	if split.Length > 0 {
+		r.end = split.Offset + split.Length
+	}
+
+	// A split that does not start the file starts after the first newline
+	// found at or after Offset-1: the line before it belongs to the
+	// previous split, even when Offset falls right on its newline
+	r.pos = split.Offset
+	if r.pos > 0 {
+		r.pos--
+	}
+	if _, err := file.Seek(r.pos, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	r.reader = bufio.NewReader(file)
+	if split.Offset > 0 {
+		skipped, err := r.reader.ReadString('\n')
+		r.pos += int64(len(skipped))
+		if err == io.EOF {
+			r.end = r.pos
+		} else if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *lineReader) Next() (string, error) {
+	line, err := r.nextLine()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// nextLine returns the next line of the split with its newline, if any
+func (r *lineReader) nextLine() (string, error) {
+	if r.end >= 0 && r.pos >= r.end {
+		return "", io.EOF
+	}
+	line, err := r.reader.ReadString('\n')
+	r.pos += int64(len(line))
+	if err == io.EOF {
+		if line == "" {
+			return "", io.EOF
+		}
+		// Last line of the file, without a newline
+		r.end = r.pos
+	} else if err != nil {
+		return "", err
+	}
+	return line, nil
+}
+
+func (r *lineReader) Close() error {
+	return r.file.Close()
+}
+
+// splitReader returns the whole split as a single record
+type splitReader struct {
+	lines *lineReader
+	done  bool
+}
+
+// NewSplitReader is a ReaderFunc returning the contents of the split,
+// newlines included, as a single record: the lines that belong to the
+// split, the whole file for a split covering it. It is the reader of the
+// map functions adapted by MapAdapter, which expect a whole document.
+func NewSplitReader(split Split) (RecordReader, error) {
+	lines, err := NewLineReader(split)
+	if err != nil {
+		return nil, err
+	}
+	return &splitReader{lines: lines.(*lineReader)}, nil
+}
+
+func (r *splitReader) Next() (string, error) {
+	if r.done {
+		return "", io.EOF
+	}
+	var contents strings.Builder
+	for {
+		line, err := r.lines.nextLine()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		contents.WriteString(line)
+	}
+	r.done = true
+	return contents.String(), nil
+}
+
+func (r *splitReader) Close() error {
+	return r.lines.Close()
+}
@@ -6,6 +6,19 @@ import (
 	"unicode"
 )
 
+// WordCountApp is the name under which the word count application is
+// registered.
+const WordCountApp = "wordcount"
+
+func init() {
+	RegisterApp(App{
+		Name:         WordCountApp,
+		Map:          MapWordCount,
+		ReduceValues: ReduceWordCountValues,
+		Combine:      ReduceWordCount,
+	})
+}
+
 // The mapping function is called once for each piece of the input.
 // In this framework, the value is the contents of the file being
 // processed. The return value should be a slice of key/value pairs,
@@ -39,3 +52,15 @@ func ReduceWordCount(key string, values []string) string {
 	}
 	return strconv.Itoa(total)
 }
+
+// ReduceWordCountValues is ReduceWordCount reading the counts of a word one
+// at a time, so that very frequent words do not need all their counts in
+// memory at once
+func ReduceWordCountValues(key string, values ValueIterator, emit EmitFunc) {
+	total := 0
+	for v, ok := values.Next(); ok; v, ok = values.Next() {
+		count, _ := strconv.Atoi(v)
+		total += count
+	}
+	emit(key, strconv.Itoa(total))
+}
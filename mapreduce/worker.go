@@ -1,85 +1,483 @@
 package mapreduce
 
 import (
-	"math/rand"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
 	"net/rpc"
 	"os"
+	"sync"
 	"time"
 )
 
 // Worker execute map ou reduce
 type Worker struct {
-	id         string
-	masterAddr string
+	id      string
+	masters []string // Master addresses, the first one first
+	config  WorkerConfig
+	clock   Clock
+	mu      sync.Mutex
+	current int                    // Index in masters of the master last reached
+	clients map[string]*rpc.Client // Connections to the masters, by address
+	running map[TaskRef]bool       // Attempts running in the slots of the worker
+	addr    string                 // Address of the shuffle server, empty without one
+	shuffle *http.Server           // Shuffle server, nil without one
+
+	// Failures of the worker, see Kill, Pause and Slow
+	killed   chan struct{} // Closed by Kill
+	kill     sync.Once
+	paused   chan struct{} // Closed by Resume, nil unless paused
+	slowdown time.Duration // Added to the execution of every task
+}
+
+// WorkerConfig holds the settings of a worker
+type WorkerConfig struct {
+	// HeartbeatInterval is how often the worker tells the master it is alive,
+	// one second when not positive. It should match the master's
+	// MasterConfig.HeartbeatInterval.
+	HeartbeatInterval time.Duration
+	// StandbyMasters are tried in turn when the master cannot be reached or
+	// is not the leader, see MasterConfig.LeasePath
+	StandbyMasters []string
+	// Dir is the directory of the files written by the tasks of the
+	// worker, the current directory when empty
+	Dir string
+	// ShuffleAddr, when set, is the address of an HTTP server serving the
+	// files of the worker to the other workers and to the master, see
+	// ShuffleHandler. Without it, every worker and the master must share
+	// the same directory.
+	ShuffleAddr string
+	// FetchTimeout is how long a reduce task may take to fetch an
+	// intermediate file from a shuffle server before the output of its map
+	// task is taken for lost, DefaultFetchTimeout when zero
+	FetchTimeout time.Duration
+	// Slots is the number of tasks the worker runs at once, 1 when zero
+	Slots int
+	// Chaos injects faults into the tasks of the worker, none by default
+	Chaos ChaosConfig
+	// PollTimeout is how long the master may hold a request for a task
+	// when none is ready. When zero, the worker asks again every second.
+	PollTimeout time.Duration
+	// Rest is how long the worker waits after executing a task before
+	// reporting it, none when zero. It only slows the job down, for demos.
+	Rest time.Duration
+	// Clock tells the time for heartbeats and waits, the real clock when
+	// nil. It should be the clock of the master.
+	Clock Clock
+}
+
+// DefaultWorkerConfig returns the settings used by NewWorker
+func DefaultWorkerConfig() WorkerConfig {
+	return WorkerConfig{HeartbeatInterval: time.Second, PollTimeout: 10 * time.Second}
 }
 
 // NewWorker initialise new worker
 func NewWorker(id, masterAddr string) *Worker {
-	rand.Seed(time.Now().UnixNano())
+	return NewWorkerWithConfig(id, masterAddr, DefaultWorkerConfig())
+}
+
+// NewWorkerWithConfig is like NewWorker with explicit settings
+func NewWorkerWithConfig(id, masterAddr string, config WorkerConfig) *Worker {
+	// Without it, the worker would send heartbeats without pause
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = DefaultWorkerConfig().HeartbeatInterval
+	}
 	return &Worker{
-		id:         id,
-		masterAddr: masterAddr,
+		id:      id,
+		masters: append([]string{masterAddr}, config.StandbyMasters...),
+		config:  config,
+		clock:   clockOrReal(config.Clock),
+		clients: make(map[string]*rpc.Client),
+		running: make(map[TaskRef]bool),
+		killed:  make(chan struct{}),
+	}
+}
+
+// call calls an RPC of the master, trying the next master of the list when
+// the current one cannot be reached or is not the leader
+func (w *Worker) call(method string, args, reply interface{}) error {
+	w.mu.Lock()
+	current := w.current
+	w.mu.Unlock()
+
+	var err error
+	for i := 0; i < len(w.masters); i++ {
+		addr := w.masters[(current+i)%len(w.masters)]
+		err = w.callMaster(addr, method, args, reply)
+		if _, failed := err.(rpc.ServerError); err == nil || (failed && !IsNotLeader(err)) {
+			if i > 0 {
+				Debug("Worker %s: Switched to master %s\n", w.id, addr)
+				w.mu.Lock()
+				w.current = (current + i) % len(w.masters)
+				w.mu.Unlock()
+			}
+			return err
+		}
 	}
+	return err
 }
 
-// Run starts the worker loop
-func (w *Worker) Run() {
+// callMaster calls an RPC of the master at addr over the connection kept
+// to it. A broken connection is dropped, and dialed again once if it had
+// been used before: the master may have closed it since.
+func (w *Worker) callMaster(addr, method string, args, reply interface{}) error {
+	w.await()
+	defer w.await()
 	for {
-		// Request task
-		client, err := rpc.DialHTTP("tcp", w.masterAddr)
+		client, reused, err := w.client(addr)
 		if err != nil {
-			Debug("Worker %s: Cannot connect to master: %v\n", w.id, err)
-			time.Sleep(time.Second)
-			continue
+			return err
 		}
-		var reply GetTaskReply
-		err = client.Call("Master.GetTask", &GetTaskArgs{WorkerID: w.id}, &reply)
+		err = client.Call(method, args, reply)
+		if _, failed := err.(rpc.ServerError); err == nil || failed {
+			return err
+		}
+		w.drop(addr, client)
+		if !reused {
+			return err
+		}
+		Debug("Worker %s: Connection to master %s lost, reconnecting: %v\n", w.id, addr, err)
+	}
+}
+
+// client returns the connection to the master at addr, dialing it when
+// there is none, and whether it was already there
+func (w *Worker) client(addr string) (*rpc.Client, bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.dead() {
+		return nil, false, ErrWorkerKilled
+	}
+	if client, ok := w.clients[addr]; ok {
+		return client, true, nil
+	}
+	client, err := rpc.DialHTTP("tcp", addr)
+	if err != nil {
+		return nil, false, err
+	}
+	w.clients[addr] = client
+	return client, false, nil
+}
+
+// drop closes a broken connection to the master at addr, unless another
+// call already replaced it
+func (w *Worker) drop(addr string, client *rpc.Client) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.clients[addr] == client {
+		delete(w.clients, addr)
+	}
+	client.Close()
+}
+
+// closeClients closes the connections to the masters
+func (w *Worker) closeClients() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for addr, client := range w.clients {
 		client.Close()
+		delete(w.clients, addr)
+	}
+}
+
+// heartbeat tells the master this worker is alive, every HeartbeatInterval,
+// independently of the task being executed
+func (w *Worker) heartbeat(done <-chan struct{}) {
+	for {
+		select {
+		case <-w.clock.After(w.config.HeartbeatInterval):
+		case <-done:
+			return
+		case <-w.killed:
+			return
+		}
+		args := HeartbeatArgs{WorkerID: w.id, Slots: w.slots()}
+		w.mu.Lock()
+		for ref := range w.running {
+			args.Running = append(args.Running, ref)
+		}
+		w.mu.Unlock()
+		err := w.call("Master.Heartbeat", &args, &HeartbeatReply{})
+		if err != nil {
+			Debug("Worker %s: Heartbeat failed: %v\n", w.id, err)
+		}
+	}
+}
+
+// serveShuffle starts the shuffle server of the worker
+func (w *Worker) serveShuffle() (*http.Server, error) {
+	listener, err := net.Listen("tcp", w.config.ShuffleAddr)
+	if err != nil {
+		return nil, err
+	}
+	w.addr = advertisedAddr(listener)
+	Debug("Worker %s: Serving files of %s on %s\n", w.id, w.config.Dir, w.addr)
+	server := &http.Server{Handler: ShuffleHandler(w.config.Dir)}
+	w.mu.Lock()
+	w.shuffle = server
+	w.mu.Unlock()
+	go server.Serve(listener)
+	return server, nil
+}
+
+// slots returns the number of tasks the worker runs at once
+func (w *Worker) slots() int {
+	return max(w.config.Slots, 1)
+}
+
+// Run starts the worker loop in each slot of the worker. It returns once
+// the master tells the worker to exit, with ErrWorkerKilled once the worker
+// is killed, or if the directory or the shuffle server of the worker cannot
+// be set up.
+func (w *Worker) Run() error {
+	if w.config.Dir != "" {
+		if err := os.MkdirAll(w.config.Dir, 0755); err != nil {
+			return err
+		}
+	}
+	if w.config.ShuffleAddr != "" {
+		server, err := w.serveShuffle()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+		}()
+	}
+	defer w.closeClients()
+	if w.config.Chaos.enabled() {
+		Debug("Worker %s: Injecting faults with seed %d\n", w.id, w.config.Chaos.Seed)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go w.heartbeat(done)
+	var slots sync.WaitGroup
+	for i := 0; i < w.slots(); i++ {
+		slots.Add(1)
+		go func() {
+			defer slots.Done()
+			w.runSlot()
+		}()
+	}
+	slots.Wait()
+	if w.dead() {
+		return ErrWorkerKilled
+	}
+	return nil
+}
+
+// runSlot asks the master for tasks and runs them one after the other,
+// until the master tells the worker to exit
+func (w *Worker) runSlot() {
+	for !w.dead() {
+		// Request task
+		var reply GetTaskReply
+		err := w.call("Master.GetTask", &GetTaskArgs{WorkerID: w.id, Apps: Apps(), Address: w.addr, Slots: w.slots(), Wait: w.config.PollTimeout}, &reply)
 		if err != nil {
 			Debug("Worker %s: GetTask failed: %v\n", w.id, err)
-			time.Sleep(time.Second)
+			w.sleep(time.Second)
 			continue
 		}
 
 		if reply.Task.Type == IdleTask {
-			time.Sleep(time.Second)
+			// The master already held the request for PollTimeout
+			if w.config.PollTimeout <= 0 {
+				w.sleep(time.Second)
+			}
 			continue
 		}
-
-		// Simulate crash (5%) or delay (10%)
-		if rand.Float64() < 0.05 {
-			Debug("Worker %s: Simulating crash for task %d\n", w.id, reply.Task.ID)
-			os.Exit(1)
+		if reply.Task.Type == ExitTask {
+			Debug("Worker %s: Master told us to exit\n", w.id)
+			return
 		}
-		if rand.Float64() < 0.1 {
-			Debug("Worker %s: Simulating delay for task %d\n", w.id, reply.Task.ID)
-			time.Sleep(5 * time.Second)
+		if w.dropReply(reply.Task) {
+			continue
 		}
+		ref := TaskRef{JobName: reply.Task.JobName, TaskID: reply.Task.ID, Attempt: reply.Task.Attempt, Tag: reply.Task.Tag}
+		w.mu.Lock()
+		w.running[ref] = true
+		w.mu.Unlock()
+		w.runTask(reply.Task)
+		w.mu.Lock()
+		delete(w.running, ref)
+		w.mu.Unlock()
+	}
+}
+
+// runTask executes a task and reports the outcome to the master
+func (w *Worker) runTask(task Task) {
+	chaos := w.config.Chaos
+	if chaos.Injects(ChaosCrash, task) {
+		w.chaosExit(ChaosCrash, task)
+	}
+	if chaos.Injects(ChaosDelay, task) {
+		Debug("Worker %s: Chaos: delay of %v at task %s/%d (attempt %d)\n", w.id, chaos.delay(), task.JobName, task.ID, task.Attempt)
+		w.sleep(chaos.delay())
+	}
+	w.mu.Lock()
+	slowdown := w.slowdown
+	w.mu.Unlock()
+	w.sleep(slowdown)
 
-		// Execute task
-		if reply.Task.Type == MapTask {
-			Debug("Worker %s: Executing map task %d\n", w.id, reply.Task.ID)
-			DoMap(reply.Task.JobName, reply.Task.MapTaskNumber, reply.Task.File, reply.Task.NReduce, MapWordCount)
-		} else if reply.Task.Type == ReduceTask {
-			Debug("Worker %s: Executing reduce task %d\n", w.id, reply.Task.ID)
-			DoReduce(reply.Task.JobName, reply.Task.ReduceTaskNumber, reply.Task.NMap, ReduceWordCount)
+	// Execute task
+	counters, err := w.execute(task)
+	if w.dead() {
+		return
+	}
+	if err != nil {
+		Debug("Worker %s: Task %d failed: %v\n", w.id, task.ID, err)
+		var failedReply ReportTaskFailedReply
+		err = w.call("Master.ReportTaskFailed", &ReportTaskFailedArgs{JobName: task.JobName, TaskID: task.ID, Attempt: task.Attempt, Tag: task.Tag, WorkerID: w.id, Error: err.Error(), Kind: errorKind(err), LostMaps: lostMapTasks(err)}, &failedReply)
+		if err != nil {
+			Debug("Worker %s: ReportTaskFailed failed for task %d: %v\n", w.id, task.ID, err)
 		}
+		return
+	}
 
-		// Wait for 3 seconds after task execution
-		Debug("Worker %s: Resting for 3 seconds after task %d\n", w.id, reply.Task.ID)
-		time.Sleep(3 * time.Second)
+	if chaos.Injects(ChaosBeforeReport, task) {
+		w.chaosExit(ChaosBeforeReport, task)
+	}
 
-		// Report completion
-		client, err = rpc.DialHTTP("tcp", w.masterAddr)
-		if err != nil {
-			Debug("Worker %s: Cannot report task %d: %v\n", w.id, reply.Task.ID, err)
-			continue
+	// Wait after task execution
+	if w.config.Rest > 0 {
+		Debug("Worker %s: Resting for %v after task %d\n", w.id, w.config.Rest, task.ID)
+		w.sleep(w.config.Rest)
+	}
+
+	// Report completion
+	var doneReply ReportTaskDoneReply
+	err = w.call("Master.ReportTaskDone", &ReportTaskDoneArgs{JobName: task.JobName, TaskID: task.ID, Attempt: task.Attempt, Tag: task.Tag, WorkerID: w.id, Counters: counters, Address: w.addr}, &doneReply)
+	if err != nil {
+		Debug("Worker %s: ReportTaskDone failed for task %d: %v\n", w.id, task.ID, err)
+	}
+}
+
+// sleep waits for d on the clock of the worker, or until it is killed
+func (w *Worker) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-w.clock.After(d):
+	case <-w.killed:
+	}
+}
+
+// dead tells whether the worker was killed
+func (w *Worker) dead() bool {
+	select {
+	case <-w.killed:
+		return true
+	default:
+		return false
+	}
+}
+
+// await blocks while the worker is paused
+func (w *Worker) await() {
+	w.mu.Lock()
+	paused := w.paused
+	w.mu.Unlock()
+	if paused == nil {
+		return
+	}
+	select {
+	case <-paused:
+	case <-w.killed:
+	}
+}
+
+// Kill makes the worker crash: it stops talking to the master and to the
+// other workers at once, and its running tasks are abandoned. Run then
+// returns ErrWorkerKilled.
+func (w *Worker) Kill() {
+	w.kill.Do(func() {
+		Debug("Worker %s: Killed\n", w.id)
+		close(w.killed)
+		w.mu.Lock()
+		shuffle := w.shuffle
+		w.mu.Unlock()
+		if shuffle != nil {
+			shuffle.Close()
 		}
-		var doneReply ReportTaskDoneReply
-		err = client.Call("Master.ReportTaskDone", &ReportTaskDoneArgs{TaskID: reply.Task.ID, WorkerID: w.id}, &doneReply)
-		client.Close()
-		if err != nil {
-			Debug("Worker %s: ReportTaskDone failed for task %d: %v\n", w.id, reply.Task.ID, err)
+		w.closeClients()
+	})
+}
+
+// Pause cuts the worker off from the master, as a long stall or a network
+// partition would: heartbeats, requests for tasks and reports wait for
+// Resume, while running tasks go on.
+func (w *Worker) Pause() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.paused == nil {
+		Debug("Worker %s: Paused\n", w.id)
+		w.paused = make(chan struct{})
+	}
+}
+
+// Resume undoes Pause
+func (w *Worker) Resume() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.paused != nil {
+		Debug("Worker %s: Resumed\n", w.id)
+		close(w.paused)
+		w.paused = nil
+	}
+}
+
+// Slow makes every task the worker starts from now on take d longer
+func (w *Worker) Slow(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.slowdown = d
+}
+
+// execute runs a map or reduce task. A panic of the application functions
+// is returned as an error.
+func (w *Worker) execute(task Task) (counters Counters, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
 		}
+	}()
+
+	// The master only hands out tasks for advertised apps, but never run
+	// a task we cannot resolve
+	app, ok := LookupApp(task.App)
+	if !ok {
+		return counters, fmt.Errorf("unknown app %q", task.App)
+	}
+	partitioner, err := ParsePartitioner(task.Partitioner)
+	if err != nil {
+		return counters, err
+	}
+
+	if task.Type == MapTask {
+		Debug("Worker %s: Executing map task %d\n", w.id, task.ID)
+		split := Split{File: task.File, Offset: task.Offset, Length: task.Length}
+		return DoMapWithOptions(task.JobName, task.MapTaskNumber, split, task.NReduce, app.recordMapper(), Options{
+			Combiner:    app.Combine,
+			Partitioner: partitioner,
+			Reader:      app.recordReader(),
+			AttemptTag:  task.Tag,
+			Dir:         w.config.Dir,
+			AfterWrite:  w.afterWrite(task),
+		})
+	} else if task.Type == ReduceTask {
+		Debug("Worker %s: Executing reduce task %d\n", w.id, task.ID)
+		return DoReduceWithOptions(task.JobName, task.ReduceTaskNumber, task.NMap, app.iterReducer(), Options{
+			MemoryBudget:     task.MemoryBudget,
+			AttemptTag:       task.Tag,
+			MapAttempts:      task.MapAttempts,
+			Dir:              w.config.Dir,
+			OpenIntermediate: ShuffleFetcher(task.MapLocations, w.config.Dir, w.config.FetchTimeout),
+			AfterWrite:       w.afterWrite(task),
+		})
 	}
+	return counters, fmt.Errorf("cannot execute %s task", task.Type)
 }
@@ -0,0 +1,52 @@
+package tests
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"v_enonce/mapreduce"
+)
+
+// assertPanics checks that f panics
+func assertPanics(t *testing.T, what string, f func()) {
+	t.Helper()
+	defer func() {
+		if recover() == nil {
+			t.Errorf("%s did not panic", what)
+		}
+	}()
+	f()
+}
+
+// registryRuns names the app of each run of TestRegisterApp, since apps
+// stay registered
+var registryRuns int
+
+func TestRegisterApp(t *testing.T) {
+	registryRuns++
+	name := fmt.Sprintf("registrytest%d", registryRuns)
+	app := mapreduce.App{Name: name, Map: mapF, Reduce: reduceF}
+	mapreduce.RegisterApp(app)
+
+	got, ok := mapreduce.LookupApp(name)
+	if !ok || got.Name != name || got.Map == nil || got.Reduce == nil {
+		t.Fatalf("LookupApp returned %+v, %v for a registered app", got, ok)
+	}
+	if !slices.Contains(mapreduce.Apps(), name) || !slices.Contains(mapreduce.Apps(), mapreduce.WordCountApp) {
+		t.Errorf("Apps returned %v, want %s and %s among them", mapreduce.Apps(), name, mapreduce.WordCountApp)
+	}
+	if _, ok := mapreduce.LookupApp("unregistered"); ok {
+		t.Errorf("LookupApp found an app that was never registered")
+	}
+
+	assertPanics(t, "registering an app twice", func() { mapreduce.RegisterApp(app) })
+	assertPanics(t, "registering an app without name", func() {
+		mapreduce.RegisterApp(mapreduce.App{Map: mapF, Reduce: reduceF})
+	})
+	assertPanics(t, "registering an app without reduce function", func() {
+		mapreduce.RegisterApp(mapreduce.App{Name: "noreduce", Map: mapF})
+	})
+	if _, ok := mapreduce.LookupApp("noreduce"); ok {
+		t.Errorf("an app rejected by RegisterApp was registered")
+	}
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"v_enonce/mapreduce"
+)
+
+func TestCancelJobWhileTasksRun(t *testing.T) {
+	m, _ := submitJob(t, mapreduce.DefaultMasterConfig(), "canceljob", map[string]string{
+		"cancel_a.txt": "foo bar foo",
+		"cancel_b.txt": "bar baz",
+	}, 1)
+	defer mapreduce.CleanIntermediary("canceljob", 2, 1)
+
+	// Both map tasks run when the job is cancelled
+	done, failed := getTask(t, m, "w1"), getTask(t, m, "w2")
+	var reply mapreduce.CancelJobReply
+	err := m.CancelJob(&mapreduce.CancelJobArgs{Name: "canceljob"}, &reply)
+	checkErrFatal(t, err, "CancelJob failed: %v", err)
+	if reply.Job.State != mapreduce.JobCancelled {
+		t.Fatalf("job is %s after CancelJob, want cancelled", reply.Job.State)
+	}
+	if err := m.CancelJob(&mapreduce.CancelJobArgs{Name: "canceljob"}, &reply); err == nil {
+		t.Errorf("a cancelled job was cancelled again")
+	}
+	if err := m.CancelJob(&mapreduce.CancelJobArgs{Name: "nosuchjob"}, &reply); err == nil {
+		t.Errorf("an unknown job was cancelled")
+	}
+	if task := getTask(t, m, "w3"); task.Type != mapreduce.IdleTask {
+		t.Fatalf("got %s task %s/%d of a cancelled job", task.Type, task.JobName, task.ID)
+	}
+
+	// The attempts go on and write their files after the cleanup; their
+	// late reports change nothing but remove them
+	execute(t, done)
+	execute(t, failed)
+	reportDone(t, m, "w1", done)
+	err = m.ReportTaskFailed(&mapreduce.ReportTaskFailedArgs{JobName: failed.JobName, TaskID: failed.ID, Attempt: failed.Attempt, Tag: failed.Tag, WorkerID: "w2", Error: "late"}, &mapreduce.ReportTaskFailedReply{})
+	checkErrFatal(t, err, "ReportTaskFailed failed: %v", err)
+	var status mapreduce.GetJobReply
+	err = m.GetJob(&mapreduce.GetJobArgs{Name: "canceljob"}, &status)
+	checkErrFatal(t, err, "GetJob failed: %v", err)
+	if status.Job.State != mapreduce.JobCancelled || status.Job.TasksDone != 0 {
+		t.Errorf("job is %s with %d tasks done after late reports, want cancelled with none", status.Job.State, status.Job.TasksDone)
+	}
+	if left, _ := filepath.Glob("mrtmp.canceljob-*"); len(left) > 0 {
+		t.Errorf("files %v of a cancelled job left after late reports", left)
+	}
+}
+
+func TestMrctlCancel(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs mrctl")
+	}
+	bin := filepath.Join(t.TempDir(), "mrctl")
+	if out, err := exec.Command("go", "build", "-o", bin, "v_enonce/cmd/mrctl").CombinedOutput(); err != nil {
+		t.Fatalf("cannot build mrctl: %v\n%s", err, out)
+	}
+	config := mapreduce.DefaultMasterConfig()
+	config.RPCAddr = "localhost:0"
+	config.HTTPAddr = "localhost:0"
+	m, _ := submitJob(t, config, "ctljob", map[string]string{"ctl_a.txt": "foo bar"}, 1)
+	err := m.Start()
+	checkErrFatal(t, err, "Start failed: %v", err)
+	defer m.Shutdown(context.Background())
+	mrctl := func(args ...string) (string, error) {
+		out, err := exec.Command(bin, append([]string{"-master", m.RPCAddr()}, args...)...).CombinedOutput()
+		return string(out), err
+	}
+
+	out, err := mrctl("cancel", "ctljob")
+	checkErrFatal(t, err, "mrctl cancel failed: %v\n%s", err, out)
+	if !strings.Contains(out, "cancelled") {
+		t.Errorf("mrctl cancel printed %q, want the job cancelled", out)
+	}
+	out, err = mrctl("-json", "list")
+	checkErrFatal(t, err, "mrctl list failed: %v\n%s", err, out)
+	var jobs []mapreduce.JobStatus
+	if err := json.Unmarshal([]byte(out), &jobs); err != nil || len(jobs) != 1 || jobs[0].State != mapreduce.JobCancelled {
+		t.Errorf("mrctl -json list printed %q, want ctljob cancelled", out)
+	}
+
+	// Cancelling again fails, and so does watching the job
+	if out, err := mrctl("cancel", "ctljob"); err == nil {
+		t.Errorf("mrctl cancelled a cancelled job: %s", out)
+	}
+	if out, err := mrctl("watch", "ctljob"); err == nil {
+		t.Errorf("mrctl watch of a cancelled job succeeded: %s", out)
+	}
+	os.Remove(mapreduce.AnsName("ctljob"))
+}
@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"v_enonce/mapreduce"
+)
+
+// chaosTasks returns the first attempts of n map and n reduce tasks
+func chaosTasks(n int) []mapreduce.Task {
+	var tasks []mapreduce.Task
+	for i := 0; i < n; i++ {
+		tasks = append(tasks,
+			mapreduce.Task{JobName: "chaosjob", ID: i, Type: mapreduce.MapTask, Attempt: 1},
+			mapreduce.Task{JobName: "chaosjob", ID: n + i, Type: mapreduce.ReduceTask, Attempt: 1})
+	}
+	return tasks
+}
+
+func TestChaosReplaysTheSameFaults(t *testing.T) {
+	config := mapreduce.ChaosConfig{
+		Seed:   42,
+		Map:    mapreduce.ChaosRates{Crash: 0.3},
+		Reduce: mapreduce.ChaosRates{DropReply: 0.5},
+	}
+	tasks := chaosTasks(1000)
+	crashes, drops := 0, 0
+	for _, task := range tasks {
+		crash := config.Injects(mapreduce.ChaosCrash, task)
+		drop := config.Injects(mapreduce.ChaosDropReply, task)
+		// Rates are per phase
+		if (crash && task.Type != mapreduce.MapTask) || (drop && task.Type != mapreduce.ReduceTask) {
+			t.Fatalf("fault injected in %s task %d with a rate of 0", task.Type, task.ID)
+		}
+		if crash {
+			crashes++
+		}
+		if drop {
+			drops++
+		}
+		// The same seed gives the same draws, in any order
+		if again := config.Injects(mapreduce.ChaosCrash, task); again != crash {
+			t.Fatalf("task %d crashed once out of two draws", task.ID)
+		}
+	}
+	if crashes < 250 || crashes > 350 {
+		t.Errorf("%d crashes in 1000 map tasks at a rate of 0.3", crashes)
+	}
+	if drops < 450 || drops > 550 {
+		t.Errorf("%d dropped replies in 1000 reduce tasks at a rate of 0.5", drops)
+	}
+
+	// Another seed, or a retry of the task, gets other draws
+	other := config
+	other.Seed = 43
+	same, retried := 0, 0
+	for _, task := range tasks[:200] {
+		if config.Injects(mapreduce.ChaosCrash, task) == other.Injects(mapreduce.ChaosCrash, task) {
+			same++
+		}
+		retry := task
+		retry.Attempt = 2
+		if config.Injects(mapreduce.ChaosCrash, task) == config.Injects(mapreduce.ChaosCrash, retry) {
+			retried++
+		}
+	}
+	if same == 200 || retried == 200 {
+		t.Errorf("draws do not depend on the seed or on the attempt")
+	}
+
+	// No fault by default
+	for _, task := range tasks {
+		if (mapreduce.ChaosConfig{}).Injects(mapreduce.ChaosCrash, task) {
+			t.Fatalf("fault injected in task %d without a chaos config", task.ID)
+		}
+	}
+}
+
+func TestLoadChaosConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chaos.json")
+	err := os.WriteFile(path, []byte(`{"Seed": 7, "Map": {"MidWrite": 0.25}, "Reduce": {"BeforeReport": 1}, "Delay": 1000000}`), 0644)
+	checkErrFatal(t, err, "cannot write chaos config: %v", err)
+	config, err := mapreduce.LoadChaosConfig(path)
+	checkErrFatal(t, err, "LoadChaosConfig failed: %v", err)
+	want := mapreduce.ChaosConfig{
+		Seed:   7,
+		Map:    mapreduce.ChaosRates{MidWrite: 0.25},
+		Reduce: mapreduce.ChaosRates{BeforeReport: 1},
+		Delay:  1000000,
+	}
+	if config != want {
+		t.Errorf("got %+v, want %+v", config, want)
+	}
+
+	err = os.WriteFile(path, []byte(`{"Seed": "seven"}`), 0644)
+	checkErrFatal(t, err, "cannot write chaos config: %v", err)
+	if _, err := mapreduce.LoadChaosConfig(path); err == nil {
+		t.Errorf("LoadChaosConfig accepted an invalid file")
+	}
+}
+
+func TestAfterWriteSeesPartialOutput(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.txt")
+	err := os.WriteFile(input, []byte("foo bar foo\nbaz\n"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+
+	// The hook sees the records on disk as they are written
+	name := mapreduce.AttemptName(filepath.Join(dir, mapreduce.ReduceName("writejob", 0, 0)), "t1")
+	var sizes []int64
+	counters, err := mapreduce.DoMapWithOptions("writejob", 0, mapreduce.Split{File: input}, 1, mapreduce.MapAdapter(mapF), mapreduce.Options{
+		AttemptTag: "t1",
+		Dir:        dir,
+		AfterWrite: func(written int64) {
+			info, err := os.Stat(name)
+			checkErrFatal(t, err, "cannot stat %s: %v", name, err)
+			sizes = append(sizes, info.Size())
+		},
+	})
+	checkErrFatal(t, err, "DoMapWithOptions failed: %v", err)
+	if len(sizes) < 2 || int64(len(sizes)) != counters.MapOutputRecords {
+		t.Fatalf("AfterWrite called %d times for %d records", len(sizes), counters.MapOutputRecords)
+	}
+	for i := 1; i < len(sizes); i++ {
+		if sizes[i-1] == 0 || sizes[i] <= sizes[i-1] {
+			t.Fatalf("output sizes %v seen by AfterWrite, want records flushed one by one", sizes)
+		}
+	}
+}
+
+func TestClusterRecoversFromDroppedTaskReplies(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.SpeculationFactor = 0
+	c := startCluster(t, 0, config)
+	c.addWorker(mapreduce.WorkerConfig{Chaos: mapreduce.ChaosConfig{
+		Seed:   1,
+		Map:    mapreduce.ChaosRates{DropReply: 0.5},
+		Reduce: mapreduce.ChaosRates{DropReply: 0.5},
+	}})
+	files := c.submit("dropjob", clusterInputs, 2)
+
+	// The attempts whose GetTask reply was dropped run again once the
+	// heartbeats of the worker leave them out
+	c.advanceUntil("job completion", func() bool { return c.finished("dropjob") })
+	c.assertSameAsSequential("dropjob", files, 2)
+	lost := 0
+	for id := 0; id < len(clusterInputs)+2; id++ {
+		for _, attempt := range jobTask(t, c.master, "dropjob", id).Attempts {
+			if attempt.Status == "lost" {
+				lost++
+			}
+		}
+	}
+	if lost == 0 {
+		t.Errorf("no attempt was lost with half of the task replies dropped")
+	}
+}
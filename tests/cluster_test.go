@@ -0,0 +1,223 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"v_enonce/mapreduce"
+)
+
+// cluster is a master and workers running in the test process, on
+// ephemeral ports and on a fake clock. Workers keep their files in
+// directories of their own and serve them over HTTP.
+type cluster struct {
+	t       *testing.T
+	clock   *mapreduce.FakeClock
+	master  *mapreduce.Master
+	workers []*mapreduce.Worker
+	exited  []chan error // Error of Run, by worker
+}
+
+// clusterHeartbeat is the heartbeat interval of the clusters, on their
+// fake clock
+const clusterHeartbeat = time.Second
+
+// startCluster starts a master with config and nWorkers workers, named w0,
+// w1 and so on
+func startCluster(t *testing.T, nWorkers int, config mapreduce.MasterConfig) *cluster {
+	t.Helper()
+	c := &cluster{t: t, clock: mapreduce.NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))}
+	config.RPCAddr = "localhost:0"
+	config.HTTPAddr = "localhost:0"
+	config.HeartbeatInterval = clusterHeartbeat
+	config.Clock = c.clock
+	m, err := mapreduce.NewMasterWithConfig(config)
+	checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+	err = m.Start()
+	checkErrFatal(t, err, "Start failed: %v", err)
+	c.master = m
+	t.Cleanup(c.stop)
+
+	for i := 0; i < nWorkers; i++ {
+		c.addWorker(mapreduce.WorkerConfig{})
+	}
+	return c
+}
+
+// addWorker starts a worker with the settings of config that the cluster
+// does not set itself, named after its index
+func (c *cluster) addWorker(config mapreduce.WorkerConfig) *mapreduce.Worker {
+	config.HeartbeatInterval = clusterHeartbeat
+	config.Dir = c.t.TempDir()
+	config.ShuffleAddr = "localhost:0"
+	config.PollTimeout = 10 * time.Second
+	config.Clock = c.clock
+	w := mapreduce.NewWorkerWithConfig(fmt.Sprintf("w%d", len(c.workers)), c.master.RPCAddr(), config)
+	exited := make(chan error, 1)
+	go func() { exited <- w.Run() }()
+	c.workers = append(c.workers, w)
+	c.exited = append(c.exited, exited)
+	return w
+}
+
+// stop kills the workers and shuts the master down
+func (c *cluster) stop() {
+	for i, w := range c.workers {
+		w.Kill()
+		select {
+		case <-c.exited[i]:
+		case <-time.After(5 * time.Second):
+			c.t.Errorf("worker w%d still running after it was killed", i)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.master.Shutdown(ctx)
+}
+
+// submit writes the inputs of a word count job and submits it
+func (c *cluster) submit(name string, inputs []string, nReduce int) []string {
+	c.t.Helper()
+	dir := c.t.TempDir()
+	var files []string
+	for i, contents := range inputs {
+		file := filepath.Join(dir, fmt.Sprintf("input%d.txt", i))
+		err := os.WriteFile(file, []byte(contents), 0644)
+		checkErrFatal(c.t, err, "cannot create input file: %v", err)
+		files = append(files, file)
+	}
+	c.t.Cleanup(func() { os.Remove(mapreduce.AnsName(name)) })
+	err := c.master.Submit(mapreduce.JobSpec{Name: name, App: mapreduce.WordCountApp, Files: files, NReduce: nReduce})
+	checkErrFatal(c.t, err, "Submit failed: %v", err)
+	return files
+}
+
+// advanceUntil moves the clock forward one heartbeat interval at a time
+// until cond holds. The short real pauses let the master and the workers
+// act on every step.
+func (c *cluster) advanceUntil(what string, cond func() bool) {
+	c.t.Helper()
+	for step := 0; step < 600; step++ {
+		if cond() {
+			return
+		}
+		c.clock.Advance(clusterHeartbeat)
+		time.Sleep(5 * time.Millisecond)
+	}
+	c.t.Fatalf("%s did not happen within 600 heartbeats", what)
+}
+
+// finished tells whether the job is done or failed
+func (c *cluster) finished(name string) bool {
+	return jobFinished(c.t, c.master, name)
+}
+
+// waitRunning waits until the worker runs a task
+func (c *cluster) waitRunning(workerID string) {
+	c.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if worker, ok := findWorker(c.t, c.master, workerID); ok && len(worker.Running) > 0 {
+			return
+		}
+	}
+	c.t.Fatalf("worker %s got no task", workerID)
+}
+
+// assertSameAsSequential checks that the output of the job is the output
+// of Sequential on the same files
+func (c *cluster) assertSameAsSequential(name string, files []string, nReduce int) {
+	c.t.Helper()
+	status := waitForJob(c.t, c.master, name)
+	if status.State != mapreduce.JobDone {
+		c.t.Fatalf("job ended %s: %s", status.State, status.Error)
+	}
+	seq := "seq" + name
+	err := mapreduce.Sequential(seq, files, nReduce, mapF, reduceF)
+	checkErrFatal(c.t, err, "Sequential failed: %v", err)
+	defer os.Remove(mapreduce.AnsName(seq))
+	defer mapreduce.CleanIntermediary(seq, len(files), nReduce)
+
+	got, err := os.ReadFile(status.Output)
+	checkErrFatal(c.t, err, "cannot read output: %v", err)
+	want, err := os.ReadFile(mapreduce.AnsName(seq))
+	checkErrFatal(c.t, err, "cannot read output of Sequential: %v", err)
+	if !bytes.Equal(got, want) {
+		c.t.Errorf("output of job %s differs from the output of Sequential:\n%s\nwant:\n%s", name, got, want)
+	}
+}
+
+// clusterInputs are the inputs of the jobs of the clusters
+var clusterInputs = []string{
+	"the quick brown fox jumps over the lazy dog",
+	"The dog sleeps. The fox runs!",
+	"a b c a b a",
+	"lazy afternoon, quick lunch",
+}
+
+func TestClusterOutputMatchesSequential(t *testing.T) {
+	c := startCluster(t, 3, mapreduce.DefaultMasterConfig())
+	files := c.submit("clusterjob", clusterInputs, 3)
+	// No task waits on the clock
+	c.assertSameAsSequential("clusterjob", files, 3)
+}
+
+func TestClusterRecoversFromKilledWorker(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.SpeculationFactor = 0
+	c := startCluster(t, 3, config)
+	c.workers[0].Slow(time.Hour)
+	files := c.submit("killjob", clusterInputs, 2)
+	c.waitRunning("w0")
+
+	// The task of the killed worker runs again once it misses heartbeats
+	c.workers[0].Kill()
+	if err := <-c.exited[0]; !errors.Is(err, mapreduce.ErrWorkerKilled) {
+		t.Errorf("Run of a killed worker returned %v, want ErrWorkerKilled", err)
+	}
+	c.exited[0] <- nil
+	c.advanceUntil("job completion", func() bool { return c.finished("killjob") })
+	if status := workerInfo(t, c.master, "w0").Status; status != "crashed" {
+		t.Errorf("killed worker is %s, want crashed", status)
+	}
+	c.assertSameAsSequential("killjob", files, 2)
+}
+
+func TestClusterBacksUpSlowWorker(t *testing.T) {
+	c := startCluster(t, 3, mapreduce.DefaultMasterConfig())
+	c.workers[0].Slow(time.Hour)
+	files := c.submit("slowjob", clusterInputs, 2)
+	c.waitRunning("w0")
+
+	// The job completes long before the slow task would
+	c.advanceUntil("job completion", func() bool { return c.finished("slowjob") })
+	if status := workerInfo(t, c.master, "w0").Status; status == "crashed" {
+		t.Errorf("slow worker declared crashed while it sent heartbeats")
+	}
+	c.assertSameAsSequential("slowjob", files, 2)
+}
+
+func TestClusterRecoversFromPausedWorker(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.SpeculationFactor = 0
+	c := startCluster(t, 3, config)
+	c.workers[0].Slow(time.Hour)
+	files := c.submit("pausejob", clusterInputs, 2)
+	c.waitRunning("w0")
+
+	// A paused worker is taken for crashed, and its task runs elsewhere
+	c.workers[0].Pause()
+	c.advanceUntil("job completion", func() bool { return c.finished("pausejob") })
+	if status := workerInfo(t, c.master, "w0").Status; status != "crashed" {
+		t.Errorf("paused worker is %s, want crashed", status)
+	}
+	c.assertSameAsSequential("pausejob", files, 2)
+
+	// Once resumed, it is back
+	c.workers[0].Resume()
+	c.advanceUntil("return of the worker", func() bool { return workerInfo(t, c.master, "w0").Status != "crashed" })
+}
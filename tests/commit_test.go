@@ -0,0 +1,78 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"v_enonce/mapreduce"
+)
+
+func TestDuplicateAttemptsCannotCorruptOutput(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.SpeculationFactor = 2
+	m, _ := submitJob(t, config, "dup", map[string]string{
+		"dup_a.txt": "foo bar foo",
+		"dup_b.txt": "bar baz",
+	}, 2)
+
+	fast := getTask(t, m, "w1")
+	slow := getTask(t, m, "w2")
+	execute(t, fast)
+	reportDone(t, m, "w1", fast)
+	time.Sleep(20 * time.Millisecond)
+	backup := getTask(t, m, "w3")
+	if backup.ID != slow.ID || backup.Tag == slow.Tag {
+		t.Fatalf("got task %d tagged %q, want a backup of task %d tagged other than %q", backup.ID, backup.Tag, slow.ID, slow.Tag)
+	}
+
+	// The slow attempt dies in the middle of a write while the backup runs
+	partial := mapreduce.AttemptName(mapreduce.ReduceName("dup", slow.MapTaskNumber, 0), slow.Tag)
+	err := os.WriteFile(partial, []byte(`{"Key":"foo","Val`), 0644)
+	checkErrFatal(t, err, "cannot write partial file: %v", err)
+	execute(t, backup)
+	reportDone(t, m, "w3", backup)
+
+	// A late duplicate writing other pairs does not replace the committed
+	// output either
+	split := mapreduce.Split{File: slow.File, Offset: slow.Offset, Length: slow.Length}
+	_, err = mapreduce.DoMapWithOptions("dup", slow.MapTaskNumber, split, slow.NReduce, func(record string, emit mapreduce.EmitFunc) {
+		emit("corrupt", "100")
+	}, mapreduce.Options{AttemptTag: slow.Tag})
+	checkErrFatal(t, err, "duplicate map attempt failed: %v", err)
+	reportDone(t, m, "w2", slow)
+
+	// The backup of a reduce task commits, the original attempt reports
+	// afterwards
+	reduce0 := getTask(t, m, "w1")
+	reduce1 := getTask(t, m, "w2")
+	if reduce0.Type != mapreduce.ReduceTask || reduce1.Type != mapreduce.ReduceTask {
+		t.Fatalf("got %s and %s tasks after the map phase, want reduce", reduce0.Type, reduce1.Type)
+	}
+	execute(t, reduce0)
+	reportDone(t, m, "w1", reduce0)
+	execute(t, reduce1)
+	time.Sleep(20 * time.Millisecond)
+	backup = getTask(t, m, "w3")
+	if backup.ID != reduce1.ID {
+		t.Fatalf("got %s task %d, want a backup of reduce task %d", backup.Type, backup.ID, reduce1.ID)
+	}
+	execute(t, backup)
+	reportDone(t, m, "w3", backup)
+	reportDone(t, m, "w2", reduce1)
+
+	status := waitForJob(t, m, "dup")
+	if status.State != mapreduce.JobDone {
+		t.Fatalf("job ended %s: %s", status.State, status.Error)
+	}
+	assertEqualMaps(t, decodeMapFromFile(t, status.Output), map[string]string{"foo": "2", "bar": "2", "baz": "1"})
+
+	// No file of any attempt survives the job
+	leftovers, _ := filepath.Glob(mapreduce.AnsName("dup") + "-*")
+	for _, name := range leftovers {
+		if strings.Contains(name, ".attempt-") {
+			t.Errorf("attempt file %s left behind", name)
+		}
+	}
+}
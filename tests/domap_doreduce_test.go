@@ -2,8 +2,12 @@ package tests
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"v_enonce/mapreduce"
 )
@@ -66,7 +70,8 @@ func TestDoMap(t *testing.T) {
 
 	mapTaskNumber := 555
 	nReduce := 10
-	mapreduce.DoMap(jobName, mapTaskNumber, inputFile, nReduce, mapF)
+	err = mapreduce.DoMap(jobName, mapTaskNumber, inputFile, nReduce, mapF)
+	checkErrFatal(t, err, "DoMap failed: %v", err)
 
 	gotKeys := map[string]string{}
 	for r := 0; r < nReduce; r++ {
@@ -86,8 +91,8 @@ func TestDoReduce(t *testing.T) {
 	nMap := 2
 
 	inputs := [][]mapreduce.KeyValue{
-		{{"apple", "1"}, {"banana", "2"}},
-		{{"apple", "1"}, {"orange", "2"}},
+		{{Key: "apple", Value: "1"}, {Key: "banana", Value: "2"}},
+		{{Key: "apple", Value: "1"}, {Key: "orange", Value: "2"}},
 	}
 	expectedKeys := map[string]string{
 		"banana": "2",
@@ -109,11 +114,126 @@ func TestDoReduce(t *testing.T) {
 		file.Close()
 	}
 
-	mapreduce.DoReduce(jobName, reduceTaskNumber, nMap, reduceF)
+	err := mapreduce.DoReduce(jobName, reduceTaskNumber, nMap, reduceF)
+	checkErrFatal(t, err, "DoReduce failed: %v", err)
 
 	fileName := mapreduce.MergeName(jobName, reduceTaskNumber)
 	defer os.Remove(fileName)
 	gotKeys := decodeMapFromFile(t, fileName)
 
 	assertEqualMaps(t, gotKeys, expectedKeys)
-}
\ No newline at end of file
+}
+func TestDoMapCombiner(t *testing.T) {
+	inputFile := "test_combine_input.txt"
+	err := os.WriteFile(inputFile, []byte("orange banana banana apple orange banana"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+	defer os.Remove(inputFile)
+
+	// One pair per word, the combiner does the aggregation
+	mapOnes := func(contents string) (res []mapreduce.KeyValue) {
+		for _, word := range strings.Fields(contents) {
+			res = append(res, mapreduce.KeyValue{Key: word, Value: "1"})
+		}
+		return
+	}
+
+	mapTaskNumber := 7
+	nReduce := 3
+	counters, err := mapreduce.DoMapWithOptions(jobName, mapTaskNumber, mapreduce.Split{File: inputFile}, nReduce, mapreduce.MapAdapter(mapOnes),
+		mapreduce.Options{Combiner: reduceF})
+	checkErrFatal(t, err, "DoMapWithOptions failed: %v", err)
+
+	gotKeys := map[string]string{}
+	for r := 0; r < nReduce; r++ {
+		fileName := mapreduce.ReduceName(jobName, mapTaskNumber, r)
+		defer os.Remove(fileName)
+		for k, v := range decodeMapFromFile(t, fileName) {
+			gotKeys[k] = v
+		}
+	}
+	assertEqualMaps(t, gotKeys, map[string]string{"banana": "3", "orange": "2", "apple": "1"})
+
+	want := mapreduce.Counters{MapInputRecords: 1, MapOutputRecords: 6, CombineInputRecords: 6, CombineOutputRecords: 3}
+	if counters != want {
+		t.Errorf("got counters %+v, want %+v", counters, want)
+	}
+}
+
+func TestDoReduceSpillsToDisk(t *testing.T) {
+	jobName := "jobspill"
+	reduceTaskNumber := 1
+	nMap := 3
+
+	expectedKeys := map[string]string{}
+	for i := 0; i < nMap; i++ {
+		fileName := mapreduce.ReduceName(jobName, i, reduceTaskNumber)
+		file, err := os.Create(fileName)
+		checkErrFatal(t, err, "cannot create file %s: %v", fileName, err)
+		defer os.Remove(fileName)
+		enc := json.NewEncoder(file)
+		for k := 0; k < 40; k++ {
+			key := fmt.Sprintf("key%02d", (k*7)%40)
+			err := enc.Encode(&mapreduce.KeyValue{Key: key, Value: strconv.Itoa(i)})
+			checkErrFatal(t, err, "cannot encode kv: %v", err)
+			expectedKeys[key] = expectedKeys[key] + strconv.Itoa(i)
+		}
+		file.Close()
+	}
+
+	// Values must reach the reduce function in map task order
+	concat := func(key string, values []string) string { return strings.Join(values, "") }
+	counters, err := mapreduce.DoReduceWithOptions(jobName, reduceTaskNumber, nMap, mapreduce.ReduceAdapter(concat),
+		mapreduce.Options{MemoryBudget: 500})
+	checkErrFatal(t, err, "DoReduceWithOptions failed: %v", err)
+
+	fileName := mapreduce.MergeName(jobName, reduceTaskNumber)
+	defer os.Remove(fileName)
+	assertEqualMaps(t, decodeMapFromFile(t, fileName), expectedKeys)
+
+	if counters.SpilledRuns < 2 {
+		t.Errorf("got %d spilled runs with a 500 byte budget, want several", counters.SpilledRuns)
+	}
+	if counters.ReduceInputRecords != 120 || counters.ReduceOutputRecords != 40 {
+		t.Errorf("got counters %+v, want 120 records in and 40 out", counters)
+	}
+	if spills, _ := filepath.Glob("mrtmp." + jobName + "-spill-*"); len(spills) != 0 {
+		t.Errorf("spill files left behind: %v", spills)
+	}
+}
+
+func TestDoReduceIterator(t *testing.T) {
+	jobName := "jobiter"
+	fileName := mapreduce.ReduceName(jobName, 0, 0)
+	encodeMapInFile(t, map[string]string{"drop": "x", "keep": "1", "pairs": "ab"}, fileName)
+	defer os.Remove(fileName)
+	fileName = mapreduce.ReduceName(jobName, 1, 0)
+	encodeMapInFile(t, map[string]string{"keep": "2", "pairs": "cd"}, fileName)
+	defer os.Remove(fileName)
+
+	// Emits nothing for "drop", only reads the first value of "keep" and
+	// emits one pair per value of "pairs"
+	reduceIter := func(key string, values mapreduce.ValueIterator, emit mapreduce.EmitFunc) {
+		switch key {
+		case "keep":
+			first, _ := values.Next()
+			emit(key, first)
+		case "pairs":
+			for v, ok := values.Next(); ok; v, ok = values.Next() {
+				emit(key+"-"+v, v)
+			}
+		}
+	}
+	counters, err := mapreduce.DoReduceWithOptions(jobName, 0, 2, reduceIter, mapreduce.Options{})
+	checkErrFatal(t, err, "DoReduceWithOptions failed: %v", err)
+
+	outName := mapreduce.MergeName(jobName, 0)
+	defer os.Remove(outName)
+	assertEqualMaps(t, decodeMapFromFile(t, outName), map[string]string{
+		"keep":     "1",
+		"pairs-ab": "ab",
+		"pairs-cd": "cd",
+	})
+	if counters.ReduceOutputRecords != 3 {
+		t.Errorf("got %d output records, want 3", counters.ReduceOutputRecords)
+	}
+}
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"v_enonce/mapreduce"
+)
+
+func TestDoMapMissingInput(t *testing.T) {
+	err := mapreduce.DoMap("missingjob", 0, "does_not_exist.txt", 1, mapF)
+	if !errors.Is(err, mapreduce.ErrMissingInput) {
+		t.Fatalf("DoMap on a missing file returned %v, want ErrMissingInput", err)
+	}
+	var taskErr *mapreduce.TaskError
+	if !errors.As(err, &taskErr) || taskErr.Op != "map" || taskErr.File != "does_not_exist.txt" {
+		t.Fatalf("DoMap returned %#v, want a map TaskError about does_not_exist.txt", err)
+	}
+	if !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("TaskError wraps %v, want the open error", errors.Unwrap(err))
+	}
+
+	err = mapreduce.Sequential("missingseq", []string{"does_not_exist.txt"}, 1, mapF, reduceF)
+	if !errors.Is(err, mapreduce.ErrMissingInput) {
+		t.Errorf("Sequential on a missing file returned %v, want ErrMissingInput", err)
+	}
+}
+
+func TestDoReduceCorruptIntermediate(t *testing.T) {
+	jobName := "corruptjob"
+	fileName := mapreduce.ReduceName(jobName, 0, 0)
+	err := os.WriteFile(fileName, []byte("{\"Key\":\"a\",\"Value\":\"1\"}\n{\"Key\":\"b\",\"Val"), 0644)
+	checkErrFatal(t, err, "cannot create file %s: %v", fileName, err)
+	defer os.Remove(fileName)
+	defer os.Remove(mapreduce.MergeName(jobName, 0))
+
+	err = mapreduce.DoReduce(jobName, 0, 1, reduceF)
+	if !errors.Is(err, mapreduce.ErrCorruptIntermediate) {
+		t.Fatalf("DoReduce on a truncated file returned %v, want ErrCorruptIntermediate", err)
+	}
+	var taskErr *mapreduce.TaskError
+	if !errors.As(err, &taskErr) || taskErr.Op != "reduce" || taskErr.File != fileName {
+		t.Errorf("DoReduce returned %#v, want a reduce TaskError about %s", err, fileName)
+	}
+	if errors.Is(err, mapreduce.ErrMissingInput) {
+		t.Errorf("corrupt file reported as missing input")
+	}
+
+	// The output of a map task that never ran is missing
+	encodeMapInFile(t, map[string]string{"a": "1"}, fileName)
+	err = mapreduce.DoReduce(jobName, 0, 2, reduceF)
+	if !errors.Is(err, mapreduce.ErrMissingInput) {
+		t.Errorf("DoReduce without the output of map task 1 returned %v, want ErrMissingInput", err)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{nil, 0},
+		{errors.New("other"), 1},
+		{&mapreduce.TaskError{Op: "map", Kind: mapreduce.ErrMissingInput, Err: os.ErrNotExist}, 3},
+		{&mapreduce.JobError{Job: "j", State: mapreduce.JobFailed, Kind: mapreduce.ErrCorruptIntermediate}, 4},
+		{&mapreduce.TaskError{Op: "reduce", Kind: mapreduce.ErrWriteFailed, Err: os.ErrPermission}, 5},
+	} {
+		if got := mapreduce.ExitCode(tc.err); got != tc.want {
+			t.Errorf("ExitCode(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"v_enonce/mapreduce"
+)
+
+// freeAddr returns a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	checkErrFatal(t, err, "cannot find a free port: %v", err)
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// startMaster starts a master process sharing the lease file of the test
+func startMaster(t *testing.T, bin, dir, name, lease string) (*exec.Cmd, string) {
+	t.Helper()
+	addr := freeAddr(t)
+	out, err := os.Create(filepath.Join(dir, name+".out"))
+	checkErrFatal(t, err, "cannot create master output: %v", err)
+	cmd := exec.Command(bin, "-serve", "-rpc", addr, "-http", freeAddr(t),
+		"-log", filepath.Join(dir, name+".log"), "-lease", lease, "-lease-duration", "400ms")
+	cmd.Stdout, cmd.Stderr = out, out
+	err = cmd.Start()
+	checkErrFatal(t, err, "cannot start master %s: %v", name, err)
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		out.Close()
+		if t.Failed() {
+			data, _ := os.ReadFile(out.Name())
+			t.Logf("output of master %s:\n%s", name, data)
+		}
+	})
+	return cmd, addr
+}
+
+// callMasters calls an RPC on the first of the masters that leads, waiting
+// for one to be elected
+func callMasters(t *testing.T, masters []string, method string, args, reply interface{}) {
+	t.Helper()
+	var err error
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		for _, addr := range masters {
+			var client *rpc.Client
+			client, err = rpc.DialHTTP("tcp", addr)
+			if err != nil {
+				continue
+			}
+			err = client.Call(method, args, reply)
+			client.Close()
+			if err == nil {
+				return
+			}
+		}
+	}
+	t.Fatalf("%s failed on every master: %v", method, err)
+}
+
+func TestStandbyMasterTakesOver(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds and runs master processes")
+	}
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "master")
+	if out, err := exec.Command("go", "build", "-o", bin, "v_enonce/cmd/master").CombinedOutput(); err != nil {
+		t.Fatalf("cannot build master: %v\n%s", err, out)
+	}
+	files := writeInputs(t, map[string]string{
+		"failover_a.txt": "foo bar foo",
+		"failover_b.txt": "bar baz",
+		"failover_c.txt": "foo qux",
+	})
+	defer os.Remove(mapreduce.AnsName("failover"))
+
+	lease := filepath.Join(dir, "lease")
+	primary, primaryAddr := startMaster(t, bin, dir, "primary", lease)
+	masters := []string{primaryAddr}
+	var submit mapreduce.SubmitJobReply
+	callMasters(t, masters, "Master.SubmitJob", &mapreduce.SubmitJobArgs{Spec: mapreduce.JobSpec{Name: "failover", App: mapreduce.WordCountApp, Files: files, NReduce: 2}}, &submit)
+	_, standbyAddr := startMaster(t, bin, dir, "standby", lease)
+	masters = append(masters, standbyAddr)
+
+	// The standby refuses tasks while the primary leads
+	client, err := rpc.DialHTTP("tcp", standbyAddr)
+	for deadline := time.Now().Add(5 * time.Second); err != nil && time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		client, err = rpc.DialHTTP("tcp", standbyAddr)
+	}
+	checkErrFatal(t, err, "cannot connect to the standby: %v", err)
+	err = client.Call("Master.GetTask", &mapreduce.GetTaskArgs{WorkerID: "w1", Apps: mapreduce.Apps()}, &mapreduce.GetTaskReply{})
+	if !mapreduce.IsNotLeader(err) {
+		t.Fatalf("standby answered GetTask with %v, want %v", err, mapreduce.ErrNotLeader)
+	}
+
+	// A worker knowing both masters runs slow tasks on the primary, until
+	// two of them completed and reached the standby
+	config := mapreduce.DefaultWorkerConfig()
+	config.StandbyMasters = []string{standbyAddr}
+	w := mapreduce.NewWorkerWithConfig("w1", primaryAddr, config)
+	w.Slow(500 * time.Millisecond)
+	exited := make(chan error, 1)
+	go func() { exited <- w.Run() }()
+	defer func() {
+		w.Kill()
+		<-exited
+	}()
+	var replica mapreduce.GetJobReply
+	for deadline := time.Now().Add(10 * time.Second); replica.Job.TasksDone < 2 && time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		client.Call("Master.GetJob", &mapreduce.GetJobArgs{Name: "failover"}, &replica)
+	}
+	client.Close()
+	if replica.Job.TasksDone < 2 || replica.Job.State != mapreduce.JobRunning {
+		t.Fatalf("standby replicated %s job with %d completed tasks, want running with 2", replica.Job.State, replica.Job.TasksDone)
+	}
+
+	// The primary dies in the middle of a task. The worker cannot reach it
+	// any more and moves on to the standby, which refuses it until it takes
+	// over, then finishes the job.
+	primary.Process.Kill()
+	primary.Wait()
+	var status mapreduce.GetJobReply
+	for deadline := time.Now().Add(15 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		callMasters(t, masters, "Master.GetJob", &mapreduce.GetJobArgs{Name: "failover"}, &status)
+		if status.Job.State == mapreduce.JobDone || status.Job.State == mapreduce.JobFailed {
+			break
+		}
+	}
+	if status.Job.State != mapreduce.JobDone {
+		t.Fatalf("job is %s after the failover: %s", status.Job.State, status.Job.Error)
+	}
+	assertEqualMaps(t, decodeMapFromFile(t, status.Job.Output), map[string]string{"foo": "3", "bar": "2", "baz": "1", "qux": "1"})
+}
+
+func TestReadLogSendsRecordsLargerThanAChunk(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "input.txt")
+	err := os.WriteFile(input, []byte("foo"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+	config := mapreduce.DefaultMasterConfig()
+	config.LogPath = filepath.Join(t.TempDir(), "master.log")
+	m, err := mapreduce.NewMasterWithConfig(config)
+	checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+
+	// The record of the job is over the 1 MiB of a ReadLog reply
+	app := strings.Repeat("a", 3<<20)
+	err = m.Submit(mapreduce.JobSpec{Name: "bigjob", App: app, Files: []string{input}, NReduce: 1})
+	checkErrFatal(t, err, "Submit failed: %v", err)
+	var reply mapreduce.ReadLogReply
+	err = m.ReadLog(&mapreduce.ReadLogArgs{}, &reply)
+	checkErrFatal(t, err, "ReadLog failed: %v", err)
+	if len(reply.Data) < len(app) || reply.Data[len(reply.Data)-1] != '\n' {
+		t.Fatalf("ReadLog returned %d bytes, want the whole record of the job", len(reply.Data))
+	}
+}
+
+func TestStaleLeaseLockIsBroken(t *testing.T) {
+	dir := t.TempDir()
+	lease := filepath.Join(dir, "lease")
+	// A master died while holding the lock
+	lock := lease + ".lock"
+	err := os.WriteFile(lock, []byte("localhost:1/1/1"), 0644)
+	checkErrFatal(t, err, "cannot create lock: %v", err)
+	stale := time.Now().Add(-time.Hour)
+	err = os.Chtimes(lock, stale, stale)
+	checkErrFatal(t, err, "cannot age lock: %v", err)
+
+	config := mapreduce.DefaultMasterConfig()
+	config.RPCAddr = "localhost:0"
+	config.HTTPAddr = "localhost:0"
+	config.LogPath = filepath.Join(dir, "master.log")
+	config.LeasePath = lease
+	config.LeaseDuration = 200 * time.Millisecond
+	m, err := mapreduce.NewMasterWithConfig(config)
+	checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+	err = m.Start()
+	checkErrFatal(t, err, "Start failed: %v", err)
+	defer m.Shutdown(context.Background())
+
+	callMasters(t, []string{m.RPCAddr()}, "Master.GetTask", &mapreduce.GetTaskArgs{WorkerID: "w1", Apps: mapreduce.Apps()}, &mapreduce.GetTaskReply{})
+	if _, err := os.Stat(lock); !os.IsNotExist(err) {
+		t.Errorf("lock left behind by the master: %v", err)
+	}
+	if left, _ := filepath.Glob(lock + ".*"); len(left) > 0 {
+		t.Errorf("files %v left behind by the master", left)
+	}
+}
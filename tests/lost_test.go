@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"v_enonce/mapreduce"
+)
+
+// runReduceLosingMaps runs a reduce task that cannot read the output of a
+// map task and reports the failure the way a worker does
+func runReduceLosingMaps(t *testing.T, m *mapreduce.Master, workerID string, task mapreduce.Task, dir string) {
+	t.Helper()
+	_, err := mapreduce.DoReduceWithOptions(task.JobName, task.ReduceTaskNumber, task.NMap, mapreduce.ReduceAdapter(reduceF), mapreduce.Options{
+		AttemptTag:       task.Tag,
+		MapAttempts:      task.MapAttempts,
+		Dir:              dir,
+		OpenIntermediate: mapreduce.ShuffleFetcher(task.MapLocations, dir, 0),
+	})
+	var lost *mapreduce.LostOutputError
+	if !errors.As(err, &lost) {
+		t.Fatalf("reduce task %d returned %v, want a LostOutputError", task.ID, err)
+	}
+	err = m.ReportTaskFailed(&mapreduce.ReportTaskFailedArgs{JobName: task.JobName, TaskID: task.ID, Attempt: task.Attempt, Tag: task.Tag, WorkerID: workerID, Error: err.Error(), LostMaps: []int{lost.MapTask}}, &mapreduce.ReportTaskFailedReply{})
+	checkErrFatal(t, err, "ReportTaskFailed failed: %v", err)
+}
+
+func TestCorruptMapOutputIsRecomputed(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.MaxAttempts = 1
+	config.SpeculationFactor = 0
+	m, _ := submitJob(t, config, "lostjob", map[string]string{
+		"lost_a.txt": "foo bar foo",
+		"lost_b.txt": "bar baz",
+	}, 1)
+
+	var maps []mapreduce.Task
+	for i := 0; i < 2; i++ {
+		task := getTask(t, m, "w1")
+		execute(t, task)
+		reportDone(t, m, "w1", task)
+		maps = append(maps, task)
+	}
+	// The output of the second map task gets truncated
+	corrupt := mapreduce.AttemptName(mapreduce.ReduceName("lostjob", maps[1].MapTaskNumber, 0), maps[1].Tag)
+	err := os.WriteFile(corrupt, []byte(`{"Key":"ba`), 0644)
+	checkErrFatal(t, err, "cannot corrupt %s: %v", corrupt, err)
+
+	reduce := getTask(t, m, "w2")
+	runReduceLosingMaps(t, m, "w2", reduce, "")
+
+	// The map task runs again before the reduce task, which is not blamed
+	rerun := getTask(t, m, "w2")
+	if rerun.ID != maps[1].ID || rerun.Attempt != 2 {
+		t.Fatalf("got %s task %d attempt %d, want attempt 2 of map task %d", rerun.Type, rerun.ID, rerun.Attempt, maps[1].ID)
+	}
+	if task := getTask(t, m, "w3"); task.Type != mapreduce.IdleTask {
+		t.Fatalf("got %s task %d while the lost map task runs again, want idle", task.Type, task.ID)
+	}
+	execute(t, rerun)
+	reportDone(t, m, "w2", rerun)
+	retry := getTask(t, m, "w3")
+	if retry.ID != reduce.ID || retry.Failures != 0 {
+		t.Fatalf("got task %d with %d failures, want reduce task %d without failures", retry.ID, retry.Failures, reduce.ID)
+	}
+	execute(t, retry)
+	reportDone(t, m, "w3", retry)
+
+	status := waitForJob(t, m, "lostjob")
+	if status.State != mapreduce.JobDone {
+		t.Fatalf("job ended %s: %s", status.State, status.Error)
+	}
+	assertEqualMaps(t, decodeMapFromFile(t, status.Output), map[string]string{"foo": "2", "bar": "2", "baz": "1"})
+}
+
+func TestMapOutputLostAgainCountsAsFailure(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.MaxAttempts = 2
+	config.SpeculationFactor = 0
+	m, _ := submitJob(t, config, "againjob", map[string]string{"again_a.txt": "foo bar foo"}, 1)
+	defer mapreduce.CleanIntermediary("againjob", 1, 1)
+
+	// The output of the map task is corrupt every time it runs: the first
+	// loss is free, the next ones count until the job fails
+	reduces := 0
+	for task := getTask(t, m, "w1"); task.Type != mapreduce.IdleTask && reduces < 10; task = getTask(t, m, "w1") {
+		if task.Type == mapreduce.ReduceTask {
+			reduces++
+			runReduceLosingMaps(t, m, "w1", task, "")
+			continue
+		}
+		execute(t, task)
+		corrupt := mapreduce.AttemptName(mapreduce.ReduceName("againjob", task.MapTaskNumber, 0), task.Tag)
+		err := os.WriteFile(corrupt, []byte(`{"Key":"fo`), 0644)
+		checkErrFatal(t, err, "cannot corrupt %s: %v", corrupt, err)
+		reportDone(t, m, "w1", task)
+	}
+	status := waitForJob(t, m, "againjob")
+	if status.State != mapreduce.JobFailed || reduces != 3 {
+		t.Fatalf("job ended %s after %d reduce attempts, want failed after 3", status.State, reduces)
+	}
+}
+
+func TestMapOutputOfDeadWorkerIsRecomputed(t *testing.T) {
+	m, _ := submitJob(t, mapreduce.DefaultMasterConfig(), "deadjob", map[string]string{"dead_a.txt": "foo bar foo"}, 1)
+
+	dirs := map[string]string{"w1": t.TempDir(), "w2": t.TempDir()}
+	servers := make(map[string]*httptest.Server)
+	for id, dir := range dirs {
+		servers[id] = httptest.NewServer(mapreduce.ShuffleHandler(dir))
+		defer servers[id].Close()
+	}
+	addr := func(id string) string { return strings.TrimPrefix(servers[id].URL, "http://") }
+	getTaskOn := func(id string) mapreduce.Task {
+		t.Helper()
+		var reply mapreduce.GetTaskReply
+		err := m.GetTask(&mapreduce.GetTaskArgs{WorkerID: id, Apps: mapreduce.Apps(), Address: addr(id)}, &reply)
+		checkErrFatal(t, err, "GetTask failed: %v", err)
+		return reply.Task
+	}
+	runOn := func(id string, task mapreduce.Task) {
+		t.Helper()
+		executeIn(t, task, dirs[id])
+		err := m.ReportTaskDone(&mapreduce.ReportTaskDoneArgs{JobName: task.JobName, TaskID: task.ID, Attempt: task.Attempt, Tag: task.Tag, WorkerID: id, Address: addr(id)}, &mapreduce.ReportTaskDoneReply{})
+		checkErrFatal(t, err, "ReportTaskDone failed: %v", err)
+	}
+
+	// The worker holding the output of the map task dies
+	mapTask := getTaskOn("w1")
+	runOn("w1", mapTask)
+	servers["w1"].Close()
+
+	reduce := getTaskOn("w2")
+	runReduceLosingMaps(t, m, "w2", reduce, dirs["w2"])
+	rerun := getTaskOn("w2")
+	if rerun.ID != mapTask.ID {
+		t.Fatalf("got %s task %d, want map task %d again", rerun.Type, rerun.ID, mapTask.ID)
+	}
+	runOn("w2", rerun)
+	retry := getTaskOn("w2")
+	if retry.ID != reduce.ID || retry.MapLocations[0] != addr("w2") {
+		t.Fatalf("got task %d reading map outputs at %v, want reduce task %d reading from w2", retry.ID, retry.MapLocations, reduce.ID)
+	}
+	runOn("w2", retry)
+
+	status := waitForJob(t, m, "deadjob")
+	if status.State != mapreduce.JobDone {
+		t.Fatalf("job ended %s: %s", status.State, status.Error)
+	}
+	assertEqualMaps(t, decodeMapFromFile(t, status.Output), map[string]string{"foo": "2", "bar": "1"})
+}
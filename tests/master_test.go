@@ -0,0 +1,265 @@
+package tests
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"v_enonce/mapreduce"
+)
+
+func getTask(t *testing.T, m *mapreduce.Master, workerID string) mapreduce.Task {
+	t.Helper()
+	var reply mapreduce.GetTaskReply
+	err := m.GetTask(&mapreduce.GetTaskArgs{WorkerID: workerID, Apps: mapreduce.Apps()}, &reply)
+	checkErrFatal(t, err, "GetTask failed: %v", err)
+	return reply.Task
+}
+
+func reportDone(t *testing.T, m *mapreduce.Master, workerID string, task mapreduce.Task) {
+	t.Helper()
+	var reply mapreduce.ReportTaskDoneReply
+	err := m.ReportTaskDone(&mapreduce.ReportTaskDoneArgs{JobName: task.JobName, TaskID: task.ID, Attempt: task.Attempt, Tag: task.Tag, WorkerID: workerID}, &reply)
+	checkErrFatal(t, err, "ReportTaskDone failed: %v", err)
+}
+
+// execute runs a word count task the way a worker does
+func execute(t *testing.T, task mapreduce.Task) mapreduce.Counters {
+	t.Helper()
+	return executeIn(t, task, "")
+}
+
+// executeIn runs a word count task the way a worker keeping its files in
+// dir does
+func executeIn(t *testing.T, task mapreduce.Task, dir string) mapreduce.Counters {
+	t.Helper()
+	var counters mapreduce.Counters
+	var err error
+	if task.Type == mapreduce.MapTask {
+		split := mapreduce.Split{File: task.File, Offset: task.Offset, Length: task.Length}
+		counters, err = mapreduce.DoMapWithOptions(task.JobName, task.MapTaskNumber, split, task.NReduce, mapreduce.MapAdapter(mapF), mapreduce.Options{AttemptTag: task.Tag, Dir: dir, Reader: mapreduce.NewSplitReader})
+	} else {
+		counters, err = mapreduce.DoReduceWithOptions(task.JobName, task.ReduceTaskNumber, task.NMap, mapreduce.ReduceAdapter(reduceF), mapreduce.Options{
+			AttemptTag:       task.Tag,
+			MapAttempts:      task.MapAttempts,
+			Dir:              dir,
+			OpenIntermediate: mapreduce.ShuffleFetcher(task.MapLocations, dir, 0),
+		})
+	}
+	checkErrFatal(t, err, "%s task %d failed: %v", task.Type, task.ID, err)
+	return counters
+}
+
+// writeInputs writes input files in the current directory, removed at the
+// end of the test, and returns their names in order
+func writeInputs(t *testing.T, inputs map[string]string) []string {
+	t.Helper()
+	var files []string
+	for name, contents := range inputs {
+		err := os.WriteFile(name, []byte(contents), 0644)
+		checkErrFatal(t, err, "cannot create input file: %v", err)
+		t.Cleanup(func() { os.Remove(name) })
+		files = append(files, name)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// submitJob writes the inputs of a word count job and submits it to a new
+// master with config. It returns the master and the input files.
+func submitJob(t *testing.T, config mapreduce.MasterConfig, name string, inputs map[string]string, nReduce int) (*mapreduce.Master, []string) {
+	t.Helper()
+	files := writeInputs(t, inputs)
+	t.Cleanup(func() { os.Remove(mapreduce.AnsName(name)) })
+	m, err := mapreduce.NewMasterWithConfig(config)
+	checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+	err = m.Submit(mapreduce.JobSpec{Name: name, App: mapreduce.WordCountApp, Files: files, NReduce: nReduce})
+	checkErrFatal(t, err, "Submit failed: %v", err)
+	return m, files
+}
+
+// jobFinished tells whether the job is done or failed
+func jobFinished(t *testing.T, m *mapreduce.Master, name string) bool {
+	t.Helper()
+	var reply mapreduce.GetJobReply
+	err := m.GetJob(&mapreduce.GetJobArgs{Name: name}, &reply)
+	checkErrFatal(t, err, "GetJob failed: %v", err)
+	return reply.Job.State == mapreduce.JobDone || reply.Job.State == mapreduce.JobFailed
+}
+
+// waitForJob polls the master until the job has finished
+func waitForJob(t *testing.T, m *mapreduce.Master, name string) mapreduce.JobStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var reply mapreduce.GetJobReply
+		err := m.GetJob(&mapreduce.GetJobArgs{Name: name}, &reply)
+		checkErrFatal(t, err, "GetJob failed: %v", err)
+		if reply.Job.State == mapreduce.JobDone || reply.Job.State == mapreduce.JobFailed {
+			return reply.Job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", name)
+	return mapreduce.JobStatus{}
+}
+
+func TestReduceWaitsForMapPhase(t *testing.T) {
+	files := writeInputs(t, map[string]string{"barrier_a.txt": "foo", "barrier_b.txt": "bar"})
+	m, err := mapreduce.NewMaster("barrier", mapreduce.WordCountApp, files, 1)
+	checkErrFatal(t, err, "NewMaster failed: %v", err)
+
+	map0 := getTask(t, m, "w1")
+	map1 := getTask(t, m, "w2")
+	if map0.Type != mapreduce.MapTask || map1.Type != mapreduce.MapTask {
+		t.Fatalf("expected two map tasks, got %s and %s", map0.Type, map1.Type)
+	}
+
+	reportDone(t, m, "w1", map0)
+	if task := getTask(t, m, "w1"); task.Type != mapreduce.IdleTask {
+		t.Fatalf("got %s task while map task %d is still running, want idle", task.Type, map1.ID)
+	}
+
+	reportDone(t, m, "w2", map1)
+	if task := getTask(t, m, "w1"); task.Type != mapreduce.ReduceTask {
+		t.Fatalf("got %s task after the map phase, want reduce", task.Type)
+	}
+}
+
+func TestUnknownAppIsNotAssigned(t *testing.T) {
+	files := writeInputs(t, map[string]string{"noapp_a.txt": "foo"})
+	m, err := mapreduce.NewMaster("noapp", "does-not-exist", files, 1)
+	checkErrFatal(t, err, "NewMaster failed: %v", err)
+	if task := getTask(t, m, "w1"); task.Type != mapreduce.IdleTask {
+		t.Fatalf("got %s task for an app the worker lacks, want idle", task.Type)
+	}
+}
+
+func TestBackupAttemptForStraggler(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.SpeculationFactor = 2
+	m, _ := submitJob(t, config, "backup", map[string]string{"backup_a.txt": "foo", "backup_b.txt": "bar"}, 1)
+
+	fast := getTask(t, m, "w1")
+	slow := getTask(t, m, "w2")
+	reportDone(t, m, "w1", fast)
+	time.Sleep(20 * time.Millisecond)
+
+	backup := getTask(t, m, "w3")
+	if backup.Type != mapreduce.MapTask || backup.ID != slow.ID || backup.Attempt != 2 {
+		t.Fatalf("got %s task %d attempt %d, want backup attempt 2 of map task %d", backup.Type, backup.ID, backup.Attempt, slow.ID)
+	}
+
+	reportDone(t, m, "w3", backup)
+	reportDone(t, m, "w2", slow)
+	if task := getTask(t, m, "w1"); task.Type != mapreduce.ReduceTask {
+		t.Fatalf("got %s task once the backup won, want reduce", task.Type)
+	}
+}
+
+func TestJobQueue(t *testing.T) {
+	m, err := mapreduce.NewMasterWithConfig(mapreduce.DefaultMasterConfig())
+	checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+	inputs := map[string]string{"queue1": "foo bar foo", "queue2": "baz baz qux"}
+	for _, name := range []string{"queue1", "queue2"} {
+		input := name + "_input.txt"
+		err := os.WriteFile(input, []byte(inputs[name]), 0644)
+		checkErrFatal(t, err, "cannot create input file: %v", err)
+		defer os.Remove(input)
+		defer os.Remove(mapreduce.AnsName(name))
+
+		var reply mapreduce.SubmitJobReply
+		err = m.SubmitJob(&mapreduce.SubmitJobArgs{Spec: mapreduce.JobSpec{Name: name, App: mapreduce.WordCountApp, Files: []string{input}, NReduce: 2}}, &reply)
+		checkErrFatal(t, err, "SubmitJob failed: %v", err)
+		if reply.Job.State != mapreduce.JobQueued {
+			t.Errorf("job %s is %s after submission, want queued", name, reply.Job.State)
+		}
+	}
+	err = m.Submit(mapreduce.JobSpec{Name: "queue1", App: mapreduce.WordCountApp, Files: []string{"x"}, NReduce: 1})
+	if err == nil {
+		t.Errorf("a second job named queue1 was accepted")
+	}
+	// Files of jobs are named after them, and must not be taken for the
+	// files of another job: queue1-res-0 would end in MergeName(queue1, 0)
+	for _, name := range []string{"../queue3", "dir/queue3", `dir\queue3`, "..", "queue1-res-0", "queue1-0-0", "queue*", "queue 3"} {
+		if err := m.Submit(mapreduce.JobSpec{Name: name, App: mapreduce.WordCountApp, Files: []string{"x"}, NReduce: 1}); err == nil {
+			t.Errorf("job named %q was accepted", name)
+		}
+	}
+
+	// Inputs must be readable
+	for _, input := range []string{"queue3_missing.txt", "."} {
+		err := m.Submit(mapreduce.JobSpec{Name: "queue3", App: mapreduce.WordCountApp, Files: []string{input}, NReduce: 1})
+		if !errors.Is(err, mapreduce.ErrMissingInput) {
+			t.Errorf("job reading %s submitted with %v, want ErrMissingInput", input, err)
+		}
+	}
+
+	// A single worker serves both jobs, in submission order
+	var order []string
+	for task := getTask(t, m, "w1"); task.Type != mapreduce.IdleTask; task = getTask(t, m, "w1") {
+		order = append(order, task.JobName)
+		execute(t, task)
+		reportDone(t, m, "w1", task)
+	}
+	if want := []string{"queue1", "queue1", "queue1", "queue2", "queue2", "queue2"}; !slices.Equal(order, want) {
+		t.Errorf("tasks handed out for jobs %v, want %v", order, want)
+	}
+
+	for name, want := range map[string]map[string]string{
+		"queue1": {"foo": "2", "bar": "1"},
+		"queue2": {"baz": "2", "qux": "1"},
+	} {
+		status := waitForJob(t, m, name)
+		if status.State != mapreduce.JobDone || filepath.Base(status.Output) != mapreduce.AnsName(name) {
+			t.Fatalf("job %s ended %s with output %q", name, status.State, status.Output)
+		}
+		assertEqualMaps(t, decodeMapFromFile(t, status.Output), want)
+	}
+
+	var list mapreduce.ListJobsReply
+	err = m.ListJobs(&mapreduce.ListJobsArgs{}, &list)
+	checkErrFatal(t, err, "ListJobs failed: %v", err)
+	if len(list.Jobs) != 2 || list.Jobs[0].Name != "queue1" || list.Jobs[1].Name != "queue2" {
+		t.Errorf("ListJobs returned %+v, want queue1 then queue2", list.Jobs)
+	}
+}
+
+func TestFailedTaskIsRetriedThenFailsJob(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.MaxAttempts = 2
+	m, _ := submitJob(t, config, "failing", map[string]string{"failing_a.txt": "foo"}, 1)
+
+	reportFailed := func(workerID string, task mapreduce.Task, reason string) {
+		t.Helper()
+		var reply mapreduce.ReportTaskFailedReply
+		err := m.ReportTaskFailed(&mapreduce.ReportTaskFailedArgs{JobName: task.JobName, TaskID: task.ID, Attempt: task.Attempt, Tag: task.Tag, WorkerID: workerID, Error: reason, Kind: mapreduce.ErrMissingInput.Error()}, &reply)
+		checkErrFatal(t, err, "ReportTaskFailed failed: %v", err)
+	}
+
+	first := getTask(t, m, "w1")
+	reportFailed("w1", first, "cannot open missing.txt")
+	retry := getTask(t, m, "w2")
+	if retry.ID != first.ID || retry.Attempt != 2 {
+		t.Fatalf("got task %d attempt %d, want attempt 2 of failed task %d", retry.ID, retry.Attempt, first.ID)
+	}
+	if retry.Failures != 1 || retry.Attempts[0].Status != "failed" || retry.Attempts[0].Error != "cannot open missing.txt" {
+		t.Fatalf("first attempt is %+v with %d failures, want failed with its error", retry.Attempts[0], retry.Failures)
+	}
+
+	reportFailed("w2", retry, "cannot open missing.txt")
+	status := waitForJob(t, m, "failing")
+	if status.State != mapreduce.JobFailed || !strings.Contains(status.Error, "failed 2 times") || !strings.Contains(status.Error, "missing.txt") {
+		t.Fatalf("job is %s with error %q, want failed after 2 attempts with the last error", status.State, status.Error)
+	}
+	if err := status.Err(); !errors.Is(err, mapreduce.ErrMissingInput) {
+		t.Errorf("job error is %v, want one matching ErrMissingInput", err)
+	}
+	if task := getTask(t, m, "w1"); task.Type != mapreduce.IdleTask {
+		t.Errorf("got %s task of a failed job, want idle", task.Type)
+	}
+}
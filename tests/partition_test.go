@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"v_enonce/mapreduce"
+)
+
+func TestParsePartitioner(t *testing.T) {
+	cases := []struct {
+		spec string
+		key  string
+		want int
+	}{
+		{"range:g,p", "apple", 0},
+		{"range:g,p", "grape", 1},
+		{"range:g,p", "orange", 1},
+		{"range:g,p", "pear", 2},
+		{"range:b,c,d,e", "zebra", 2}, // clipped to the last reduce task
+	}
+	for _, c := range cases {
+		p, err := mapreduce.ParsePartitioner(c.spec)
+		checkErrFatal(t, err, "ParsePartitioner(%q): %v", c.spec, err)
+		if got := p.Partition(c.key, 3); got != c.want {
+			t.Errorf("%s.Partition(%q) = %d, want %d", c.spec, c.key, got, c.want)
+		}
+	}
+
+	prefix, err := mapreduce.ParsePartitioner("prefix:2")
+	checkErrFatal(t, err, "ParsePartitioner(prefix:2): %v", err)
+	if prefix.Partition("banana", 10) != prefix.Partition("bandana", 10) {
+		t.Errorf("keys sharing a prefix landed in different partitions")
+	}
+
+	for _, spec := range []string{"range:p,g", "prefix:x", "nope"} {
+		if _, err := mapreduce.ParsePartitioner(spec); err == nil {
+			t.Errorf("ParsePartitioner(%q) accepted an invalid spec", spec)
+		}
+	}
+}
+
+func TestSequentialRangePartitionedOutputIsSorted(t *testing.T) {
+	input := "input_range.txt"
+	err := os.WriteFile(input, []byte("pear kiwi apple zucchini grape orange banana lemon"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+	defer os.Remove(input)
+
+	job := "rangejob"
+	opts := mapreduce.Options{Partitioner: mapreduce.RangePartitioner{Boundaries: []string{"g", "p"}}}
+	err = mapreduce.SequentialWithOptions(job, []string{input}, 3, mapreduce.MapAdapter(mapF), mapreduce.ReduceAdapter(reduceF), opts)
+	checkErrFatal(t, err, "SequentialWithOptions failed: %v", err)
+	defer os.Remove(mapreduce.AnsName(job))
+	defer mapreduce.CleanIntermediary(job, 1, 3)
+
+	file, err := os.Open(mapreduce.AnsName(job))
+	checkErrFatal(t, err, "cannot open output: %v", err)
+	defer file.Close()
+	var keys []string
+	dec := json.NewDecoder(file)
+	var kv mapreduce.KeyValue
+	for dec.Decode(&kv) == nil {
+		keys = append(keys, kv.Key)
+	}
+	if len(keys) != 8 || !sort.StringsAreSorted(keys) {
+		t.Errorf("output keys %v are not the 8 input words in sorted order", keys)
+	}
+}
+
+func TestPartitionOutOfRangeFailsMapTask(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.txt")
+	err := os.WriteFile(input, []byte("foo bar\n"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+
+	for _, r := range []int{-1, 2} {
+		bad := mapreduce.PartitionerFunc(func(key string, nReduce int) int { return r })
+		_, err := mapreduce.DoMapWithOptions("badpartjob", 0, mapreduce.Split{File: input}, 2, mapreduce.MapAdapter(mapF), mapreduce.Options{Dir: dir, Partitioner: bad})
+		var taskErr *mapreduce.TaskError
+		if !errors.As(err, &taskErr) || taskErr.Op != "map" {
+			t.Fatalf("map task with keys in reduce task %d of 2 returned %v, want a TaskError", r, err)
+		}
+		if left, _ := filepath.Glob(filepath.Join(dir, "mrtmp.*")); len(left) > 0 {
+			t.Errorf("failed map task left %v", left)
+		}
+	}
+}
+
+func TestCustomPartitionerIsResolvedByWorkers(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.MaxAttempts = 2
+	c := startCluster(t, 1, config)
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.txt")
+	err := os.WriteFile(input, []byte("foo bar\n"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+
+	// The master checks the built-in partitioners only
+	err = c.master.Submit(mapreduce.JobSpec{Name: "badrangejob", App: mapreduce.WordCountApp, Files: []string{input}, NReduce: 2, Partitioner: "range:p,g"})
+	if err == nil {
+		t.Errorf("job with unsorted range boundaries was accepted")
+	}
+
+	// A custom partitioner may be registered on the workers only: this
+	// worker does not know it, and fails the map task
+	err = c.master.Submit(mapreduce.JobSpec{Name: "customjob", App: mapreduce.WordCountApp, Files: []string{input}, NReduce: 2, Partitioner: "workeronly"})
+	checkErrFatal(t, err, "job with a custom partitioner was rejected: %v", err)
+	status := waitForJob(t, c.master, "customjob")
+	if status.State != mapreduce.JobFailed || !strings.Contains(status.Error, `unknown partitioner "workeronly"`) {
+		t.Errorf("job ended %s with error %q, want failed on the unknown partitioner", status.State, status.Error)
+	}
+}
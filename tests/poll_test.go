@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+	"v_enonce/mapreduce"
+)
+
+// pollTask asks the master for a task, waiting up to wait for one
+func pollTask(t *testing.T, m *mapreduce.Master, workerID string, wait time.Duration) <-chan mapreduce.Task {
+	t.Helper()
+	tasks := make(chan mapreduce.Task, 1)
+	go func() {
+		var reply mapreduce.GetTaskReply
+		err := m.GetTask(&mapreduce.GetTaskArgs{WorkerID: workerID, Apps: mapreduce.Apps(), Wait: wait}, &reply)
+		if err != nil {
+			t.Errorf("GetTask failed: %v", err)
+		}
+		tasks <- reply.Task
+	}()
+	return tasks
+}
+
+// receiveTask waits for the reply of pollTask
+func receiveTask(t *testing.T, tasks <-chan mapreduce.Task, within time.Duration) mapreduce.Task {
+	t.Helper()
+	select {
+	case task := <-tasks:
+		return task
+	case <-time.After(within):
+		t.Fatalf("no reply to GetTask within %v", within)
+		return mapreduce.Task{}
+	}
+}
+
+func TestLongPollRepliesAsSoonAsATaskIsReady(t *testing.T) {
+	err := os.WriteFile("poll_a.txt", []byte("foo bar foo"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+	defer os.Remove("poll_a.txt")
+	defer os.Remove(mapreduce.AnsName("polljob"))
+
+	// Without a task ready, the master holds the requests longer than a
+	// heartbeat interval
+	config := mapreduce.DefaultMasterConfig()
+	config.HeartbeatInterval = time.Minute
+	m, err := mapreduce.NewMasterWithConfig(config)
+	checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+	tasks := pollTask(t, m, "w1", 10*time.Second)
+	select {
+	case task := <-tasks:
+		t.Fatalf("got %s task without a job", task.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// A new job wakes the request up
+	err = m.Submit(mapreduce.JobSpec{Name: "polljob", App: mapreduce.WordCountApp, Files: []string{"poll_a.txt"}, NReduce: 1})
+	checkErrFatal(t, err, "Submit failed: %v", err)
+	mapTask := receiveTask(t, tasks, time.Second)
+	if mapTask.Type != mapreduce.MapTask {
+		t.Fatalf("got %s task, want the map task", mapTask.Type)
+	}
+
+	// So does the end of the map phase
+	tasks = pollTask(t, m, "w2", 10*time.Second)
+	execute(t, mapTask)
+	reportDone(t, m, "w1", mapTask)
+	reduce := receiveTask(t, tasks, time.Second)
+	if reduce.Type != mapreduce.ReduceTask {
+		t.Fatalf("got %s task, want the reduce task", reduce.Type)
+	}
+
+	// Requests still idle when the wait expires
+	start := time.Now()
+	if task := receiveTask(t, pollTask(t, m, "w1", 200*time.Millisecond), time.Second); task.Type != mapreduce.IdleTask {
+		t.Fatalf("got %s task while the reduce task runs, want idle", task.Type)
+	}
+	if waited := time.Since(start); waited < 200*time.Millisecond {
+		t.Errorf("idle reply after %v, want it after the wait of 200ms", waited)
+	}
+	execute(t, reduce)
+	reportDone(t, m, "w2", reduce)
+
+	status := waitForJob(t, m, "polljob")
+	if status.State != mapreduce.JobDone {
+		t.Fatalf("job ended %s: %s", status.State, status.Error)
+	}
+	assertEqualMaps(t, decodeMapFromFile(t, status.Output), map[string]string{"foo": "2", "bar": "1"})
+}
+
+func TestShutdownTellsWaitingWorkersToExit(t *testing.T) {
+	m, err := mapreduce.NewMasterWithConfig(mapreduce.DefaultMasterConfig())
+	checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+	tasks := pollTask(t, m, "w1", 10*time.Second)
+	time.Sleep(50 * time.Millisecond)
+
+	err = m.Shutdown(context.Background())
+	checkErrFatal(t, err, "Shutdown failed: %v", err)
+	if task := receiveTask(t, tasks, time.Second); task.Type != mapreduce.ExitTask {
+		t.Fatalf("got %s task after Shutdown, want exit", task.Type)
+	}
+}
@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"v_enonce/mapreduce"
+)
+
+// jobTask returns task id of the job as the master knows it
+func jobTask(t *testing.T, m *mapreduce.Master, name string, id int) mapreduce.Task {
+	t.Helper()
+	var reply mapreduce.GetJobReply
+	err := m.GetJob(&mapreduce.GetJobArgs{Name: name}, &reply)
+	checkErrFatal(t, err, "GetJob failed: %v", err)
+	return reply.Tasks[id]
+}
+
+func TestRecoverMasterAfterCrash(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.LogPath = filepath.Join(t.TempDir(), "master.log")
+	m, _ := submitJob(t, config, "recover", map[string]string{
+		"recover_a.txt": "foo bar foo",
+		"recover_b.txt": "bar baz",
+		"recover_c.txt": "foo qux",
+	}, 2)
+
+	// Two map tasks complete, the third is still running when the master
+	// dies in the middle of writing a record
+	for i := 0; i < 2; i++ {
+		task := getTask(t, m, "w1")
+		execute(t, task)
+		reportDone(t, m, "w1", task)
+	}
+	lost := getTask(t, m, "w2")
+	log, err := os.OpenFile(config.LogPath, os.O_WRONLY|os.O_APPEND, 0644)
+	checkErrFatal(t, err, "cannot open master log: %v", err)
+	log.WriteString(`{"Op":"complete","Job":"rec`)
+	log.Close()
+
+	m, err = mapreduce.RecoverMaster(config)
+	checkErrFatal(t, err, "RecoverMaster failed: %v", err)
+	var reply mapreduce.GetJobReply
+	err = m.GetJob(&mapreduce.GetJobArgs{Name: "recover"}, &reply)
+	checkErrFatal(t, err, "GetJob failed: %v", err)
+	if reply.Job.State != mapreduce.JobRunning || reply.Job.TasksDone != 2 {
+		t.Fatalf("recovered job is %s with %d tasks done, want running with 2", reply.Job.State, reply.Job.TasksDone)
+	}
+	if status := reply.Tasks[lost.ID].Status; status != "pending" {
+		t.Fatalf("task %d running at the crash is %s, want pending", lost.ID, status)
+	}
+
+	// The task goes to the same worker again, as attempt 1 of the new
+	// master. The report of the attempt started by the dead master is
+	// ignored, only the tag tells the two apart.
+	retry := getTask(t, m, "w2")
+	if retry.ID != lost.ID || retry.Attempt != lost.Attempt || retry.Tag == lost.Tag {
+		t.Fatalf("got task %d attempt %d tagged %q, want the lost task %d again, tagged anew", retry.ID, retry.Attempt, retry.Tag, lost.ID)
+	}
+	reportDone(t, m, "w2", lost)
+	task := jobTask(t, m, "recover", lost.ID)
+	if task.Status != "running" || task.Committed != "" {
+		t.Fatalf("report of the attempt of the dead master left task %d %s with attempt %q committed, want running", lost.ID, task.Status, task.Committed)
+	}
+	execute(t, retry)
+	reportDone(t, m, "w2", retry)
+	if committed := jobTask(t, m, "recover", lost.ID).Committed; committed != retry.Tag {
+		t.Fatalf("task %d committed attempt %q, want %q", lost.ID, committed, retry.Tag)
+	}
+
+	for task = getTask(t, m, "w3"); task.Type != mapreduce.IdleTask; task = getTask(t, m, "w3") {
+		execute(t, task)
+		reportDone(t, m, "w3", task)
+	}
+
+	status := waitForJob(t, m, "recover")
+	if status.State != mapreduce.JobDone {
+		t.Fatalf("recovered job ended %s: %s", status.State, status.Error)
+	}
+	assertEqualMaps(t, decodeMapFromFile(t, status.Output), map[string]string{"foo": "3", "bar": "2", "baz": "1", "qux": "1"})
+
+	// A master recovered once more sees the job as done
+	m, err = mapreduce.RecoverMaster(config)
+	checkErrFatal(t, err, "RecoverMaster failed: %v", err)
+	err = m.GetJob(&mapreduce.GetJobArgs{Name: "recover"}, &reply)
+	checkErrFatal(t, err, "GetJob failed: %v", err)
+	if reply.Job.State != mapreduce.JobDone {
+		t.Errorf("job is %s after a second recovery, want done", reply.Job.State)
+	}
+}
+
+func TestFailedMergeCleansJob(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.LogPath = filepath.Join(t.TempDir(), "master.log")
+	m, _ := submitJob(t, config, "mergefail", map[string]string{"mergefail_a.txt": "foo bar"}, 2)
+
+	// The output of the second reduce task is missing at the merge
+	for task := getTask(t, m, "w1"); task.Type != mapreduce.IdleTask; task = getTask(t, m, "w1") {
+		if task.Type == mapreduce.MapTask || task.ReduceTaskNumber == 0 {
+			execute(t, task)
+		}
+		reportDone(t, m, "w1", task)
+	}
+	status := waitForJob(t, m, "mergefail")
+	if status.State != mapreduce.JobFailed {
+		t.Fatalf("job with a missing reduce output ended %s, want failed", status.State)
+	}
+
+	// The failure is logged, no master merges the job again
+	if left, _ := filepath.Glob("mrtmp.mergefail-*"); len(left) > 0 {
+		t.Errorf("failed job left %v", left)
+	}
+	m, err := mapreduce.RecoverMaster(config)
+	checkErrFatal(t, err, "RecoverMaster failed: %v", err)
+	var reply mapreduce.GetJobReply
+	err = m.GetJob(&mapreduce.GetJobArgs{Name: "mergefail"}, &reply)
+	checkErrFatal(t, err, "GetJob failed: %v", err)
+	if reply.Job.State != mapreduce.JobFailed {
+		t.Errorf("job is %s after recovery, want failed", reply.Job.State)
+	}
+}
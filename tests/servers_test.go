@@ -0,0 +1,63 @@
+package tests
+
+import (
+	"context"
+	"net/http"
+	"net/rpc"
+	"testing"
+	"v_enonce/mapreduce"
+)
+
+func TestTwoMastersInOneProcess(t *testing.T) {
+	files := writeInputs(t, map[string]string{"servers_a.txt": "foo bar"})
+	var masters []*mapreduce.Master
+	for _, name := range []string{"first", "second"} {
+		config := mapreduce.DefaultMasterConfig()
+		config.RPCAddr = "localhost:0"
+		config.HTTPAddr = "localhost:0"
+		m, err := mapreduce.NewMasterWithConfig(config)
+		checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+		err = m.Submit(mapreduce.JobSpec{Name: name, App: mapreduce.WordCountApp, Files: files, NReduce: 1})
+		checkErrFatal(t, err, "Submit failed: %v", err)
+		if m.RPCAddr() != "" {
+			t.Errorf("RPC address %q before the master is started", m.RPCAddr())
+		}
+		err = m.Start()
+		checkErrFatal(t, err, "Start failed: %v", err)
+		defer m.Shutdown(context.Background())
+		masters = append(masters, m)
+	}
+	if masters[0].RPCAddr() == masters[1].RPCAddr() {
+		t.Fatalf("both masters listen on %s", masters[0].RPCAddr())
+	}
+
+	// Each RPC server reaches its own master
+	for i, name := range []string{"first", "second"} {
+		client, err := rpc.DialHTTP("tcp", masters[i].RPCAddr())
+		checkErrFatal(t, err, "cannot dial master %s: %v", name, err)
+		var reply mapreduce.ListJobsReply
+		err = client.Call("Master.ListJobs", &mapreduce.ListJobsArgs{}, &reply)
+		client.Close()
+		checkErrFatal(t, err, "ListJobs failed: %v", err)
+		if len(reply.Jobs) != 1 || reply.Jobs[0].Name != name {
+			t.Errorf("master %s lists %+v", name, reply.Jobs)
+		}
+	}
+
+	// The dashboard and the RPC endpoint do not share their port
+	for _, tc := range []struct {
+		url  string
+		want int
+	}{
+		{"http://" + masters[0].HTTPAddr() + "/data", http.StatusOK},
+		{"http://" + masters[0].HTTPAddr() + rpc.DefaultRPCPath, http.StatusNotFound},
+		{"http://" + masters[0].RPCAddr() + "/data", http.StatusNotFound},
+	} {
+		resp, err := http.Get(tc.url)
+		checkErrFatal(t, err, "GET %s failed: %v", tc.url, err)
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("GET %s returned %s, want %d", tc.url, resp.Status, tc.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"v_enonce/mapreduce"
+)
+
+func TestShuffleBetweenWorkerDirectories(t *testing.T) {
+	m, _ := submitJob(t, mapreduce.DefaultMasterConfig(), "shufflejob", map[string]string{
+		"shuffle_a.txt": "foo bar foo",
+		"shuffle_b.txt": "bar baz qux",
+	}, 2)
+
+	// Two workers keep their files in directories of their own and serve
+	// them over HTTP
+	dirs := map[string]string{"w1": t.TempDir(), "w2": t.TempDir()}
+	addrs := make(map[string]string)
+	for id, dir := range dirs {
+		server := httptest.NewServer(mapreduce.ShuffleHandler(dir))
+		defer server.Close()
+		addrs[id] = strings.TrimPrefix(server.URL, "http://")
+	}
+
+	run := func(id string) mapreduce.Task {
+		t.Helper()
+		var reply mapreduce.GetTaskReply
+		err := m.GetTask(&mapreduce.GetTaskArgs{WorkerID: id, Apps: mapreduce.Apps(), Address: addrs[id]}, &reply)
+		checkErrFatal(t, err, "GetTask failed: %v", err)
+		task := reply.Task
+		if task.Type == mapreduce.IdleTask {
+			t.Fatalf("worker %s got no task", id)
+		}
+		executeIn(t, task, dirs[id])
+		err = m.ReportTaskDone(&mapreduce.ReportTaskDoneArgs{JobName: task.JobName, TaskID: task.ID, Attempt: task.Attempt, Tag: task.Tag, WorkerID: id, Address: addrs[id]}, &mapreduce.ReportTaskDoneReply{})
+		checkErrFatal(t, err, "ReportTaskDone failed: %v", err)
+		return task
+	}
+	run("w1")
+	run("w2")
+	// Each reduce task reads a partition from both workers
+	for _, id := range []string{"w1", "w2"} {
+		if task := run(id); task.Type != mapreduce.ReduceTask || task.MapLocations[0] != addrs["w1"] || task.MapLocations[1] != addrs["w2"] {
+			t.Fatalf("worker %s ran %s task with map outputs at %v", id, task.Type, task.MapLocations)
+		}
+	}
+
+	status := waitForJob(t, m, "shufflejob")
+	if status.State != mapreduce.JobDone {
+		t.Fatalf("job ended %s: %s", status.State, status.Error)
+	}
+	assertEqualMaps(t, decodeMapFromFile(t, status.Output), map[string]string{"foo": "2", "bar": "2", "baz": "1", "qux": "1"})
+	if local, _ := filepath.Glob(mapreduce.AnsName("shufflejob") + "-*"); len(local) > 0 {
+		t.Errorf("intermediate files %v in the directory of the master", local)
+	}
+
+	// The master has the workers remove the files of the job
+	for id, dir := range dirs {
+		var left []string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if left, _ = filepath.Glob(filepath.Join(dir, "mrtmp.*")); len(left) == 0 {
+				break
+			}
+		}
+		if len(left) > 0 {
+			t.Errorf("files %v left on worker %s", left, id)
+		}
+	}
+
+	// Only the files of tasks are served
+	secret := filepath.Join(dirs["w1"], "secret.txt")
+	err := os.WriteFile(secret, []byte("secret"), 0644)
+	checkErrFatal(t, err, "cannot create file: %v", err)
+	resp, err := http.Get("http://" + addrs["w1"] + "/shuffle/secret.txt")
+	checkErrFatal(t, err, "GET failed: %v", err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of a file that is not a task output returned %s", resp.Status)
+	}
+	// and removed
+	for _, job := range []string{"../shufflejob", "sub/shufflejob", ".."} {
+		resp, err := http.PostForm("http://"+addrs["w1"]+"/clean", url.Values{"job": {job}, "maps": {"2"}, "reduces": {"2"}})
+		checkErrFatal(t, err, "POST failed: %v", err)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST /clean of job %q returned %s", job, resp.Status)
+		}
+	}
+}
+
+func TestShuffleFetchTimesOut(t *testing.T) {
+	// A worker that accepts the request and never answers
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	defer server.Close()
+	defer close(stalled)
+
+	start := time.Now()
+	fetch := mapreduce.ShuffleFetcher([]string{strings.TrimPrefix(server.URL, "http://")}, "", 100*time.Millisecond)
+	_, err := mapreduce.DoReduceWithOptions("stalljob", 0, 1, mapreduce.ReduceAdapter(reduceF), mapreduce.Options{Dir: t.TempDir(), OpenIntermediate: fetch})
+	var lost *mapreduce.LostOutputError
+	if !errors.As(err, &lost) || lost.MapTask != 0 {
+		t.Fatalf("reduce task fetching from a stalled worker failed with %v, want the output of map task 0 lost", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("fetch gave up after %v, want about 100ms", elapsed)
+	}
+}
+
+func TestSequentialWritesInDir(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.txt")
+	err := os.WriteFile(input, []byte("foo bar foo"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+
+	// Every file of the job, the result included, is in dir
+	err = mapreduce.SequentialWithOptions("seqdir", []string{input}, 2, mapreduce.MapAdapter(mapF), mapreduce.ReduceAdapter(reduceF), mapreduce.Options{Dir: dir, Reader: mapreduce.NewSplitReader})
+	checkErrFatal(t, err, "SequentialWithOptions failed: %v", err)
+	assertEqualMaps(t, decodeMapFromFile(t, filepath.Join(dir, mapreduce.AnsName("seqdir"))), map[string]string{"foo": "2", "bar": "1"})
+	if left, _ := filepath.Glob("mrtmp.seqdir*"); len(left) > 0 {
+		t.Errorf("job in %s wrote %v in the current directory", dir, left)
+	}
+}
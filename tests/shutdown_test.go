@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"net/rpc"
+	"os"
+	"testing"
+	"time"
+	"v_enonce/mapreduce"
+)
+
+func TestRunTellsWorkersToExitAndShutsDown(t *testing.T) {
+	err := os.WriteFile("exit_a.txt", []byte("foo bar foo"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+	defer os.Remove("exit_a.txt")
+	defer os.Remove(mapreduce.AnsName("exitjob"))
+
+	config := mapreduce.DefaultMasterConfig()
+	config.RPCAddr = "localhost:0"
+	config.HTTPAddr = "localhost:0"
+	config.Linger = 300 * time.Millisecond
+	m, err := mapreduce.NewMasterWithConfig(config)
+	checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+	err = m.Submit(mapreduce.JobSpec{Name: "exitjob", App: mapreduce.WordCountApp, Files: []string{"exit_a.txt"}, NReduce: 1})
+	checkErrFatal(t, err, "Submit failed: %v", err)
+
+	done := make(chan error)
+	go func() { done <- m.Run() }()
+	for deadline := time.Now().Add(5 * time.Second); m.RPCAddr() == "" && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client, err := rpc.DialHTTP("tcp", m.RPCAddr())
+	checkErrFatal(t, err, "cannot dial master: %v", err)
+	defer client.Close()
+
+	// A worker runs the tasks over RPC, then is told to exit
+	var task mapreduce.Task
+	for deadline := time.Now().Add(5 * time.Second); task.Type != mapreduce.ExitTask && time.Now().Before(deadline); {
+		var reply mapreduce.GetTaskReply
+		err := client.Call("Master.GetTask", &mapreduce.GetTaskArgs{WorkerID: "w1", Apps: mapreduce.Apps()}, &reply)
+		checkErrFatal(t, err, "GetTask failed: %v", err)
+		task = reply.Task
+		switch task.Type {
+		case mapreduce.MapTask, mapreduce.ReduceTask:
+			execute(t, task)
+			err = client.Call("Master.ReportTaskDone", &mapreduce.ReportTaskDoneArgs{JobName: task.JobName, TaskID: task.ID, Attempt: task.Attempt, Tag: task.Tag, WorkerID: "w1"}, &mapreduce.ReportTaskDoneReply{})
+			checkErrFatal(t, err, "ReportTaskDone failed: %v", err)
+		case mapreduce.IdleTask:
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if task.Type != mapreduce.ExitTask {
+		t.Fatalf("worker got %s task once the job was done, want exit", task.Type)
+	}
+
+	// Run returns after lingering, with the servers and their connections
+	// closed
+	select {
+	case err := <-done:
+		checkErrFatal(t, err, "Run failed: %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after lingering for %v", config.Linger)
+	}
+	if err := client.Call("Master.ListJobs", &mapreduce.ListJobsArgs{}, &mapreduce.ListJobsReply{}); err == nil {
+		t.Errorf("RPC connection still served after Run returned")
+	}
+	if other, err := rpc.DialHTTP("tcp", m.RPCAddr()); err == nil {
+		other.Close()
+		t.Errorf("RPC server still accepts connections after Run returned")
+	}
+}
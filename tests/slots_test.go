@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+	"v_enonce/mapreduce"
+)
+
+// workerInfo reads the state of a worker from the dashboard of the master
+func workerInfo(t *testing.T, m *mapreduce.Master, workerID string) mapreduce.WorkerInfo {
+	t.Helper()
+	worker, ok := findWorker(t, m, workerID)
+	if !ok {
+		t.Fatalf("worker %s not on the dashboard", workerID)
+	}
+	return worker
+}
+
+// findWorker is workerInfo for a worker the master may not know yet
+func findWorker(t *testing.T, m *mapreduce.Master, workerID string) (mapreduce.WorkerInfo, bool) {
+	t.Helper()
+	resp, err := http.Get("http://" + m.HTTPAddr() + "/data")
+	checkErrFatal(t, err, "GET /data failed: %v", err)
+	defer resp.Body.Close()
+	var data struct {
+		Workers []mapreduce.WorkerInfo `json:"workers"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&data)
+	checkErrFatal(t, err, "cannot decode /data: %v", err)
+	for _, worker := range data.Workers {
+		if worker.ID == workerID {
+			return worker, true
+		}
+	}
+	return mapreduce.WorkerInfo{}, false
+}
+
+func TestWorkerRunsTasksInSeveralSlots(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.RPCAddr = "localhost:0"
+	config.HTTPAddr = "localhost:0"
+	m, _ := submitJob(t, config, "slotsjob", map[string]string{
+		"slots_a.txt": "foo bar foo",
+		"slots_b.txt": "bar baz",
+	}, 1)
+	err := m.Start()
+	checkErrFatal(t, err, "Start failed: %v", err)
+	defer m.Shutdown(context.Background())
+
+	// A worker with two slots runs both map tasks at once
+	var maps []mapreduce.Task
+	for i := 0; i < 2; i++ {
+		var reply mapreduce.GetTaskReply
+		err := m.GetTask(&mapreduce.GetTaskArgs{WorkerID: "w1", Apps: mapreduce.Apps(), Slots: 2}, &reply)
+		checkErrFatal(t, err, "GetTask failed: %v", err)
+		if reply.Task.Type != mapreduce.MapTask {
+			t.Fatalf("got %s task in slot %d, want a map task", reply.Task.Type, i)
+		}
+		maps = append(maps, reply.Task)
+	}
+	if worker := workerInfo(t, m, "w1"); worker.Status != "working" || worker.Slots != 2 || len(worker.Running) != 2 {
+		t.Fatalf("worker is %s running %v in %d slots, want both map tasks in 2 slots", worker.Status, worker.Running, worker.Slots)
+	}
+
+	// Each task is reported on its own
+	execute(t, maps[1])
+	reportDone(t, m, "w1", maps[1])
+	worker := workerInfo(t, m, "w1")
+	want := mapreduce.TaskRef{JobName: "slotsjob", TaskID: maps[0].ID, Attempt: maps[0].Attempt, Tag: maps[0].Tag}
+	if worker.Status != "working" || len(worker.Running) != 1 || worker.Running[0] != want {
+		t.Fatalf("worker is %s running %v, want %v", worker.Status, worker.Running, want)
+	}
+	execute(t, maps[0])
+	reportDone(t, m, "w1", maps[0])
+	if worker := workerInfo(t, m, "w1"); worker.Status != "idle" || len(worker.Running) != 0 {
+		t.Fatalf("worker is %s running %v, want idle", worker.Status, worker.Running)
+	}
+
+	// Heartbeats list the attempts the worker runs
+	reduce := getTask(t, m, "w1")
+	err = m.Heartbeat(&mapreduce.HeartbeatArgs{WorkerID: "w1", Slots: 2}, &mapreduce.HeartbeatReply{})
+	checkErrFatal(t, err, "Heartbeat failed: %v", err)
+	if worker := workerInfo(t, m, "w1"); worker.Status != "idle" {
+		t.Fatalf("worker is %s after a heartbeat without tasks, want idle", worker.Status)
+	}
+	execute(t, reduce)
+	reportDone(t, m, "w1", reduce)
+
+	status := waitForJob(t, m, "slotsjob")
+	if status.State != mapreduce.JobDone {
+		t.Fatalf("job ended %s: %s", status.State, status.Error)
+	}
+	assertEqualMaps(t, decodeMapFromFile(t, status.Output), map[string]string{"foo": "2", "bar": "2", "baz": "1"})
+}
+
+func TestWorkerRunFillsItsSlots(t *testing.T) {
+	config := mapreduce.DefaultMasterConfig()
+	config.RPCAddr = "localhost:0"
+	config.HTTPAddr = "localhost:0"
+	m, _ := submitJob(t, config, "runslotsjob", map[string]string{
+		"runslots_a.txt": "foo bar foo",
+		"runslots_b.txt": "bar baz",
+		"runslots_c.txt": "baz qux",
+		"runslots_d.txt": "foo",
+	}, 1)
+	err := m.Start()
+	checkErrFatal(t, err, "Start failed: %v", err)
+	defer m.Shutdown(context.Background())
+
+	workerConfig := mapreduce.DefaultWorkerConfig()
+	workerConfig.Slots = 2
+	workerConfig.Dir = t.TempDir()
+	workerConfig.ShuffleAddr = "localhost:0"
+	w := mapreduce.NewWorkerWithConfig("w1", m.RPCAddr(), workerConfig)
+	w.Slow(200 * time.Millisecond)
+	exited := make(chan error, 1)
+	go func() { exited <- w.Run() }()
+	defer func() {
+		w.Kill()
+		<-exited
+	}()
+
+	// The worker keeps both slots busy with the map tasks, never more
+	most := 0
+	for deadline := time.Now().Add(10 * time.Second); !jobFinished(t, m, "runslotsjob") && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if worker, ok := findWorker(t, m, "w1"); ok {
+			most = max(most, len(worker.Running))
+		}
+	}
+	if most != 2 {
+		t.Errorf("worker with 2 slots ran up to %d tasks at once", most)
+	}
+	status := waitForJob(t, m, "runslotsjob")
+	if status.State != mapreduce.JobDone {
+		t.Fatalf("job ended %s: %s", status.State, status.Error)
+	}
+	assertEqualMaps(t, decodeMapFromFile(t, status.Output), map[string]string{"foo": "3", "bar": "2", "baz": "2", "qux": "1"})
+}
@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"v_enonce/mapreduce"
+)
+
+func TestSplitsReadEveryLineOnce(t *testing.T) {
+	var lines []string
+	for i := 0; i < 50; i++ {
+		lines = append(lines, fmt.Sprintf("line %d %s", i, strings.Repeat("x", i%7)))
+	}
+	inputFile := "test_split_input.txt"
+	err := os.WriteFile(inputFile, []byte(strings.Join(lines, "\n")), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+	defer os.Remove(inputFile)
+
+	// One pair per line, keyed by the line itself
+	seen := map[string]int{}
+	mapLines := func(contents string) (res []mapreduce.KeyValue) {
+		for _, line := range strings.Split(strings.TrimSuffix(contents, "\n"), "\n") {
+			if line != "" {
+				seen[line]++
+			}
+		}
+		return
+	}
+
+	for _, size := range []int64{1, 7, 10, 64, 1000} {
+		seen = map[string]int{}
+		splits, err := mapreduce.SplitFile(inputFile, size)
+		checkErrFatal(t, err, "SplitFile: %v", err)
+		for i, split := range splits {
+			_, err := mapreduce.DoMapWithOptions("splitjob", i, split, 1, mapreduce.MapAdapter(mapLines), mapreduce.Options{})
+			checkErrFatal(t, err, "DoMapWithOptions failed: %v", err)
+			os.Remove(mapreduce.ReduceName("splitjob", i, 0))
+		}
+		for _, line := range lines {
+			if seen[line] != 1 {
+				t.Errorf("split size %d: line %q read %d times", size, line, seen[line])
+			}
+		}
+		if len(seen) != len(lines) {
+			t.Errorf("split size %d: read %d distinct lines, want %d", size, len(seen), len(lines))
+		}
+	}
+}
+
+func TestLegacyMapSeesWholeSplit(t *testing.T) {
+	contents := "foo bar\nfoo baz\r\n\nqux\n"
+	inputFile := "test_whole_input.txt"
+	err := os.WriteFile(inputFile, []byte(contents), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+	defer os.Remove(inputFile)
+
+	var calls []string
+	recordMap := func(contents string) []mapreduce.KeyValue {
+		calls = append(calls, contents)
+		return mapF(contents)
+	}
+
+	// DoMap and Sequential call the map function once with the whole file
+	err = mapreduce.DoMap("wholejob", 0, inputFile, 1, recordMap)
+	checkErrFatal(t, err, "DoMap failed: %v", err)
+	os.Remove(mapreduce.ReduceName("wholejob", 0, 0))
+	if !reflect.DeepEqual(calls, []string{contents}) {
+		t.Errorf("DoMap called the map function with %q, want the whole file once", calls)
+	}
+	calls = nil
+	err = mapreduce.Sequential("wholeseq", []string{inputFile}, 1, recordMap, reduceF)
+	checkErrFatal(t, err, "Sequential failed: %v", err)
+	defer os.Remove(mapreduce.AnsName("wholeseq"))
+	defer mapreduce.CleanIntermediary("wholeseq", 1, 1)
+	if !reflect.DeepEqual(calls, []string{contents}) {
+		t.Errorf("Sequential called the map function with %q, want the whole file once", calls)
+	}
+
+	// Splits get their own lines in one call
+	calls = nil
+	splits, err := mapreduce.SplitFile(inputFile, 9)
+	checkErrFatal(t, err, "SplitFile: %v", err)
+	for i, split := range splits {
+		_, err := mapreduce.DoMapWithOptions("wholejob", i, split, 1, mapreduce.MapAdapter(recordMap), mapreduce.Options{Reader: mapreduce.NewSplitReader})
+		checkErrFatal(t, err, "DoMapWithOptions failed: %v", err)
+		os.Remove(mapreduce.ReduceName("wholejob", i, 0))
+	}
+	if len(calls) != len(splits) || strings.Join(calls, "") != contents {
+		t.Errorf("splits of %q read as %q", contents, calls)
+	}
+}
+
+func TestSequentialWithSplits(t *testing.T) {
+	input := "input_splits.txt"
+	err := os.WriteFile(input, []byte("foo bar\nfoo baz\nfoo bar\nqux\n"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+	defer os.Remove(input)
+
+	splits, err := mapreduce.SplitFile(input, 5)
+	checkErrFatal(t, err, "SplitFile: %v", err)
+	err = mapreduce.SequentialWithOptions("splitseq", []string{input}, 2, mapreduce.MapAdapter(mapF), mapreduce.ReduceAdapter(reduceF), mapreduce.Options{SplitSize: 5})
+	checkErrFatal(t, err, "SequentialWithOptions failed: %v", err)
+	defer os.Remove(mapreduce.AnsName("splitseq"))
+	defer mapreduce.CleanIntermediary("splitseq", len(splits), 2)
+
+	got := decodeMapFromFile(t, mapreduce.AnsName("splitseq"))
+	assertEqualMaps(t, got, map[string]string{"foo": "3", "bar": "2", "baz": "1", "qux": "1"})
+}
+
+// csvReader yields the comma-separated fields of a whole file as records
+type csvReader struct {
+	fields []string
+}
+
+func (r *csvReader) Next() (string, error) {
+	if len(r.fields) == 0 {
+		return "", io.EOF
+	}
+	field := r.fields[0]
+	r.fields = r.fields[1:]
+	return field, nil
+}
+
+func (r *csvReader) Close() error { return nil }
+
+func TestDoMapCustomRecordReader(t *testing.T) {
+	inputFile := "test_records.csv"
+	err := os.WriteFile(inputFile, []byte("a b,c,d e f"), 0644)
+	checkErrFatal(t, err, "cannot create input file: %v", err)
+	defer os.Remove(inputFile)
+
+	var records []string
+	mapRecord := func(record string, emit mapreduce.EmitFunc) {
+		records = append(records, record)
+		emit(record, "1")
+	}
+	opts := mapreduce.Options{Reader: func(split mapreduce.Split) (mapreduce.RecordReader, error) {
+		content, err := os.ReadFile(split.File)
+		return &csvReader{fields: strings.Split(string(content), ",")}, err
+	}}
+	counters, err := mapreduce.DoMapWithOptions("csvjob", 0, mapreduce.Split{File: inputFile}, 1, mapRecord, opts)
+	checkErrFatal(t, err, "DoMapWithOptions failed: %v", err)
+	defer os.Remove(mapreduce.ReduceName("csvjob", 0, 0))
+
+	if !reflect.DeepEqual(records, []string{"a b", "c", "d e f"}) {
+		t.Errorf("map function got records %q", records)
+	}
+	if counters.MapInputRecords != 3 || counters.MapOutputRecords != 3 {
+		t.Errorf("got counters %+v, want 3 records in and out", counters)
+	}
+}
@@ -0,0 +1,175 @@
+package tests
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"v_enonce/mapreduce"
+)
+
+// runWorker starts a real-clock master and a worker reaching it at the
+// address returned by addr, and stops both at the end of the test
+func runWorker(t *testing.T, addr func(*mapreduce.Master) string) *mapreduce.Master {
+	t.Helper()
+	config := mapreduce.DefaultMasterConfig()
+	config.RPCAddr = "localhost:0"
+	config.HTTPAddr = "localhost:0"
+	m, err := mapreduce.NewMasterWithConfig(config)
+	checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+	err = m.Start()
+	checkErrFatal(t, err, "Start failed: %v", err)
+
+	workerConfig := mapreduce.DefaultWorkerConfig()
+	workerConfig.Dir = t.TempDir()
+	workerConfig.ShuffleAddr = "localhost:0"
+	w := mapreduce.NewWorkerWithConfig("w1", addr(m), workerConfig)
+	exited := make(chan error, 1)
+	go func() { exited <- w.Run() }()
+	t.Cleanup(func() {
+		w.Kill()
+		<-exited
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		m.Shutdown(ctx)
+	})
+	return m
+}
+
+// timeJob submits a word count job and returns how long it took to finish
+func timeJob(t *testing.T, m *mapreduce.Master, name string) time.Duration {
+	t.Helper()
+	c := &cluster{t: t, master: m}
+	start := time.Now()
+	c.submit(name, clusterInputs, 2)
+	for !jobFinished(t, m, name) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("job %s not finished after 10s", name)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	elapsed := time.Since(start)
+	if status := waitForJob(t, m, name); status.State != mapreduce.JobDone {
+		t.Fatalf("job ended %s: %s", status.State, status.Error)
+	}
+	return elapsed
+}
+
+func TestWorkerRunsJobWithoutWaiting(t *testing.T) {
+	m := runWorker(t, (*mapreduce.Master).RPCAddr)
+	// Tasks are handed out and reported at once, with no rest and no poll
+	// interval in between
+	if elapsed := timeJob(t, m, "latencyjob"); elapsed > time.Second {
+		t.Errorf("job of 6 tasks took %v on an idle worker, want less than 1s", elapsed)
+	}
+}
+
+// rpcProxy forwards connections to the master, and counts and cuts them
+type rpcProxy struct {
+	listener net.Listener
+	target   string
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+}
+
+func newRPCProxy(t *testing.T, target string) *rpcProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "localhost:0")
+	checkErrFatal(t, err, "cannot listen: %v", err)
+	p := &rpcProxy{listener: listener, target: target}
+	t.Cleanup(func() {
+		listener.Close()
+		p.cut()
+	})
+	go p.serve()
+	return p
+}
+
+func (p *rpcProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		upstream, err := net.Dial("tcp", p.target)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		p.mu.Lock()
+		p.conns = append(p.conns, conn, upstream)
+		p.accepted++
+		p.mu.Unlock()
+		go io.Copy(upstream, conn)
+		go io.Copy(conn, upstream)
+	}
+}
+
+// cut closes the connections forwarded so far
+func (p *rpcProxy) cut() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		conn.Close()
+	}
+	p.conns = nil
+}
+
+// connections returns the number of connections forwarded so far
+func (p *rpcProxy) connections() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.accepted
+}
+
+func TestWorkerKeepsAndReopensConnection(t *testing.T) {
+	var proxy *rpcProxy
+	m := runWorker(t, func(m *mapreduce.Master) string {
+		proxy = newRPCProxy(t, m.RPCAddr())
+		return proxy.listener.Addr().String()
+	})
+
+	// Requests, reports and heartbeats of a job share one connection
+	timeJob(t, m, "connjob1")
+	if n := proxy.connections(); n != 1 {
+		t.Fatalf("worker opened %d connections to the master, want 1", n)
+	}
+
+	// Once it breaks, the worker dials again and goes on. The master was
+	// holding a GetTask of the worker on the broken connection: the task it
+	// hands out there never reaches the worker, and runs again once the
+	// heartbeats of the worker leave it out.
+	proxy.cut()
+	if elapsed := timeJob(t, m, "connjob2"); elapsed > 3*time.Second {
+		t.Errorf("job took %v after the connection broke, want less than 3 heartbeats", elapsed)
+	}
+	if n := proxy.connections(); n != 2 {
+		t.Errorf("worker opened %d connections to the master, want 2", n)
+	}
+}
+
+func TestZeroHeartbeatSettingsGetDefaults(t *testing.T) {
+	m, err := mapreduce.NewMasterWithConfig(mapreduce.MasterConfig{RPCAddr: "localhost:0", HTTPAddr: "localhost:0"})
+	checkErrFatal(t, err, "NewMasterWithConfig failed: %v", err)
+	err = m.Start()
+	checkErrFatal(t, err, "Start failed: %v", err)
+	defer m.Shutdown(context.Background())
+	w := mapreduce.NewWorkerWithConfig("w1", m.RPCAddr(), mapreduce.WorkerConfig{Dir: t.TempDir(), ShuffleAddr: "localhost:0", PollTimeout: time.Second})
+	exited := make(chan error, 1)
+	go func() { exited <- w.Run() }()
+	defer func() {
+		w.Kill()
+		<-exited
+	}()
+
+	// The defaults replace the zero settings: the job runs, and the worker
+	// is not taken for crashed after zero missed heartbeats
+	timeJob(t, m, "zerojob")
+	time.Sleep(100 * time.Millisecond)
+	if status := workerInfo(t, m, "w1").Status; status != "idle" {
+		t.Errorf("worker is %s with the default heartbeat settings, want idle", status)
+	}
+}